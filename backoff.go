@@ -0,0 +1,96 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "math/rand"
+  "time"
+)
+
+const default_Backoff string = "1s"
+
+const default_MaxBackoff string = "1m"
+
+// BackoffConfig sets how retries of something that keeps failing are spaced
+// out. It is embedded in the sections that retry, so its keys sit alongside
+// theirs.
+type BackoffConfig struct {
+  Backoff    string `json:"backoff"`
+  MaxBackoff string `json:"max backoff"`
+  backoff     time.Duration
+  max_backoff time.Duration
+}
+
+func (b *BackoffConfig) init() (err error) {
+  if b.Backoff == "" {
+    b.Backoff = default_Backoff
+  }
+  if b.MaxBackoff == "" {
+    b.MaxBackoff = default_MaxBackoff
+  }
+  if b.backoff, err = time.ParseDuration(b.Backoff); err == nil && b.backoff <= 0 {
+    err = errors.New("must be positive")
+  }
+  if err != nil {
+    return fmt.Errorf("backoff '%s': %s", b.Backoff, err)
+  }
+  if b.max_backoff, err = time.ParseDuration(b.MaxBackoff); err == nil && b.max_backoff < b.backoff {
+    err = errors.New("must be at least the backoff")
+  }
+  if err != nil {
+    return fmt.Errorf("max backoff '%s': %s", b.MaxBackoff, err)
+  }
+  return nil
+}
+
+// A Backoff spaces out retries of something that keeps failing. The delay
+// doubles with each failure in a row, up to a maximum, and is jittered so
+// that many forwarders that failed together, say when a server restarted,
+// don't all retry together.
+type Backoff struct {
+  target   string /* what is retried, to report in the metrics */
+  initial  time.Duration
+  max      time.Duration
+  failures uint /* failures in a row */
+}
+
+func NewBackoff(target string, config BackoffConfig) *Backoff {
+  b := &Backoff{target: target, initial: config.backoff, max: config.max_backoff}
+  // Unset, as in a config that wasn't loaded from a file
+  if b.initial <= 0 {
+    b.initial, _ = time.ParseDuration(default_Backoff)
+  }
+  if b.max < b.initial {
+    b.max, _ = time.ParseDuration(default_MaxBackoff)
+  }
+  return b
+}
+
+// Failed records another failure, and returns how long to wait before
+// trying again: between half and all of the current delay.
+func (b *Backoff) Failed() time.Duration {
+  delay := b.max
+  if b.failures < 32 {
+    if doubled := b.initial << b.failures; doubled > 0 && doubled < b.max {
+      delay = doubled
+    }
+  }
+  b.failures++
+  delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+  delay = delay.Round(time.Millisecond)
+  metrics.BackingOff(b.target, delay)
+  return delay
+}
+
+// Failures returns how many times in a row it has failed.
+func (b *Backoff) Failures() uint {
+  return b.failures
+}
+
+// Reset starts again from the initial delay, after a success.
+func (b *Backoff) Reset() {
+  if b.failures > 0 {
+    b.failures = 0
+    metrics.BackedOff(b.target)
+  }
+}
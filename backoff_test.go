@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	config := BackoffConfig{Backoff: "100ms", MaxBackoff: "1s"}
+	if err := config.init(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	backoff := NewBackoff("test", config)
+
+	// Each delay is jittered between half and all of a doubling delay
+	for i, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		if delay := backoff.Failed(); delay < max/2 || delay > max {
+			t.Errorf("Expected failure %d to back off between %v and %v, got %v", i+1, max/2, max, delay)
+		}
+	}
+	if backoff.Failures() != 6 {
+		t.Errorf("Expected 6 failures in a row, got %d", backoff.Failures())
+	}
+	if status := metrics.Status(); status.Backoff["test"] == "" {
+		t.Errorf("Expected the backoff in the status, got %v", status.Backoff)
+	}
+
+	backoff.Reset()
+	if delay := backoff.Failed(); delay > 100*time.Millisecond {
+		t.Errorf("Expected to start again from the initial delay after a reset, got %v", delay)
+	}
+	backoff.Reset()
+	if status := metrics.Status(); status.Backoff["test"] != "" {
+		t.Errorf("Expected no backoff in the status after a reset, got %v", status.Backoff)
+	}
+}
+
+func TestBackoffConfig(t *testing.T) {
+	for _, config := range []BackoffConfig{
+		{Backoff: "0s"},
+		{Backoff: "nope"},
+		{Backoff: "10s", MaxBackoff: "5s"},
+	} {
+		if err := config.init(); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+)
+
+// Field set on events whose line could not be decoded
+const codec_error_key = "json_error"
+
+// Decode parses the text of an event as a JSON object. Its top-level keys are
+// shipped as fields of their own, and the value of the line key, if present,
+// is shipped as the line. Strings are shipped as they are and other values as
+// JSON; with flatten, nested objects are shipped as "parent.child" keys
+// instead. A line that isn't a JSON object is shipped unchanged, with an
+// error field.
+func (c *CodecConfig) Decode(event *FileEvent) {
+  decoder := json.NewDecoder(bytes.NewReader([]byte(*event.Text)))
+  decoder.UseNumber()
+
+  var object map[string]interface{}
+  err := decoder.Decode(&object)
+  if err == nil && object == nil {
+    err = errors.New("not a JSON object")
+  }
+  if err == nil {
+    // Anything but whitespace after the object, even a stray '}', is an error
+    if _, trailing := decoder.Token(); trailing != io.EOF {
+      err = errors.New("unexpected data after the JSON object")
+    }
+  }
+  if err != nil {
+    event.Decoded = map[string]string{codec_error_key: err.Error()}
+    return
+  }
+
+  if line, found := object[c.LineKey]; found {
+    text := c.format(line)
+    event.Text = &text
+    delete(object, c.LineKey)
+  }
+
+  event.Decoded = make(map[string]string, len(object))
+  c.add_fields(event.Decoded, "", object)
+}
+
+func (c *CodecConfig) add_fields(fields map[string]string, prefix string, object map[string]interface{}) {
+  for key, value := range object {
+    if nested, ok := value.(map[string]interface{}); ok && c.Flatten {
+      c.add_fields(fields, prefix+key+".", nested)
+      continue
+    }
+    fields[prefix+key] = c.format(value)
+  }
+}
+
+func (c *CodecConfig) format(value interface{}) string {
+  if text, ok := value.(string); ok {
+    return text
+  }
+  encoded, err := json.Marshal(value)
+  if err != nil {
+    return fmt.Sprint(value)
+  }
+  return string(encoded)
+}
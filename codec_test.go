@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodecJSON(t *testing.T) {
+	tests := []struct {
+		flatten bool
+		text    string
+		line    string
+		decoded map[string]string
+	}{
+		{
+			false,
+			`{"message": "hello", "level": "info", "status": 200, "ok": true, "user": {"id": 7, "name": "x"}, "tags": ["a", "b"], "none": null}`,
+			"hello",
+			map[string]string{"level": "info", "status": "200", "ok": "true", "user": `{"id":7,"name":"x"}`, "tags": `["a","b"]`, "none": "null"},
+		},
+		{
+			true,
+			`{"level": "info", "user": {"id": 7, "geo": {"country": "nz"}}}`,
+			`{"level": "info", "user": {"id": 7, "geo": {"country": "nz"}}}`,
+			map[string]string{"level": "info", "user.id": "7", "user.geo.country": "nz"},
+		},
+		{
+			false,
+			`{"message": 12.50}`,
+			"12.50",
+			map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		codec := &CodecConfig{Type: "json", Flatten: test.flatten}
+		if err := codec.init(); err != nil {
+			t.Fatalf("Failed to initialize codec: %s", err)
+		}
+		text := test.text
+		event := &FileEvent{Text: &text}
+		codec.Decode(event)
+		if *event.Text != test.line {
+			t.Errorf("Expected line %q, got %q", test.line, *event.Text)
+		}
+		if !reflect.DeepEqual(event.Decoded, test.decoded) {
+			t.Errorf("Expected fields %v, got %v", test.decoded, event.Decoded)
+		}
+	}
+}
+
+func TestCodecJSONInvalid(t *testing.T) {
+	codec := &CodecConfig{Type: "json"}
+	codec.init()
+
+	for _, text := range []string{`not json`, `["an", "array"]`, `null`, `{"a": 1} trailing`, `{"a":1}}`, `{"a":1}]`, `{"a": `} {
+		line := text
+		event := &FileEvent{Text: &line}
+		codec.Decode(event)
+		if *event.Text != text {
+			t.Errorf("Expected the line to be shipped unchanged, got %q", *event.Text)
+		}
+		if event.Decoded[codec_error_key] == "" || len(event.Decoded) != 1 {
+			t.Errorf("Expected only an error field for %q, got %v", text, event.Decoded)
+		}
+	}
+
+	if err := (&CodecConfig{Type: "xml"}).init(); err == nil {
+		t.Errorf("Expected an error for an unknown codec type")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+  "bytes"
+  "compress/bzip2"
+  "compress/gzip"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+)
+
+// The compression formats files can be decompressed from
+const (
+  compression_none  = ""
+  compression_gzip  = "gzip"
+  compression_bzip2 = "bzip2"
+)
+
+// detect_compression finds the format a file is compressed in from its magic
+// bytes or, failing that, the extension of path. A compressed file that is
+// still too short to have its magic bytes is known by its extension.
+func detect_compression(file io.ReaderAt, path string) string {
+  magic := make([]byte, 4)
+  n, _ := file.ReadAt(magic, 0)
+  magic = magic[:n]
+
+  switch {
+  case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+    return compression_gzip
+  case len(magic) == 4 && bytes.HasPrefix(magic, []byte("BZh")) && magic[3] >= '1' && magic[3] <= '9':
+    // "BZh" and the block size, so plain text starting "BZh" isn't taken
+    // for bzip2
+    return compression_bzip2
+  }
+
+  switch filepath.Ext(path) {
+  case ".gz":
+    return compression_gzip
+  case ".bz2":
+    return compression_bzip2
+  }
+  return compression_none
+}
+
+// is_compressed reports whether a file is compressed, by its magic bytes or
+// extension.
+func is_compressed(path string) bool {
+  file, err := os.Open(path)
+  if err != nil {
+    return false
+  }
+  defer file.Close()
+  return detect_compression(file, path) != compression_none
+}
+
+// find_original looks for the file a compressed file was compressed from,
+// among files with known fingerprints. A compressed file is fingerprinted by
+// its decompressed content, so it matches the original for as much of it as
+// the original's fingerprint covers. The longest match wins. It returns ""
+// if there is none.
+func find_original(file string, fingerprints map[string]*Fingerprint, size int64) string {
+  f, err := os.Open(file)
+  if err != nil {
+    return ""
+  }
+  defer f.Close()
+  start, err := read_start(f, size)
+  if err != nil {
+    return ""
+  }
+
+  original := ""
+  var matched int64
+  for candidate, fingerprint := range fingerprints {
+    if candidate == file || fingerprint == nil || fingerprint.Size <= matched {
+      continue
+    }
+    if fingerprint.Matches(start) {
+      original, matched = candidate, fingerprint.Size
+    }
+  }
+  return original
+}
+
+// decompress reads the decompressed content of a file.
+func decompress(reader io.Reader, compression string) (io.Reader, error) {
+  switch compression {
+  case compression_gzip:
+    return gzip.NewReader(reader)
+  case compression_bzip2:
+    return bzip2.NewReader(reader), nil
+  }
+  return nil, fmt.Errorf("unknown compression '%s'", compression)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// "one\ntwo\n" compressed with bzip2
+var bzip2_lines = []byte("BZh91AY&SY\xa7\x14+w\x00\x00\x02\xc1\x80\x00\x10\x02\x01\x84\x80 \x00!\x80\x0c\x028\xf5\x1b\x8b\xb9\"\x9c(HS\x8a\x15\xbb\x80")
+
+func gzip_lines(text string) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write([]byte(text))
+	writer.Close()
+	return buffer.Bytes()
+}
+
+func write_temp(t *testing.T, data []byte) string {
+	file, err := ioutil.TempFile("", "logstash-forwarder-compressed")
+	if err != nil {
+		testBug(err)
+	}
+	file.Write(data)
+	file.Close()
+	return file.Name()
+}
+
+func TestDetectCompression(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		path     string
+		expected string
+	}{
+		{gzip_lines("one\n"), "app.log.1", compression_gzip},
+		{bzip2_lines, "app.log.1", compression_bzip2},
+		{[]byte("one\n"), "app.log", compression_none},
+		{[]byte("BZh, a plain line\n"), "app.log", compression_none},
+		// Too short for magic bytes yet
+		{[]byte{0x1f}, "app.log.1.gz", compression_gzip},
+		{nil, "app.log.1.bz2", compression_bzip2},
+	}
+	for _, test := range tests {
+		if compression := detect_compression(bytes.NewReader(test.data), test.path); compression != test.expected {
+			t.Errorf("Expected %s to be compressed with '%s', got '%s'", test.path, test.expected, compression)
+		}
+	}
+}
+
+func TestHarvestCompressed(t *testing.T) {
+	for _, test := range []struct {
+		data     []byte
+		offset   int64
+		line     uint64
+		expected []string
+		complete bool
+	}{
+		{gzip_lines("one\ntwo\nthree\n"), 4, 1, []string{"two", "three"}, true},
+		{bzip2_lines, 0, 0, []string{"one", "two"}, true},
+		// Still being written, so read up to where it ends for now
+		{gzip_lines("one\ntwo\nthree\n")[:30], 0, 0, nil, false},
+	} {
+		path := write_temp(t, test.data)
+		defer os.Remove(path)
+
+		output := make(chan *FileEvent, 10)
+		h := &Harvester{
+			Path:       path,
+			FileConfig: FileConfig{Decompress: true, deadtime: time.Hour, poll_interval: time.Second},
+			Offset:     test.offset,
+			Line:       test.line,
+			FinishChan: make(chan *FileState, 1),
+			StopChan:   make(chan bool),
+		}
+		h.Harvest(output)
+		close(output)
+
+		var lines []string
+		var last *FileEvent
+		for event := range output {
+			if event.Text != nil {
+				lines = append(lines, *event.Text)
+			}
+			last = event
+		}
+		if len(lines) < len(test.expected) {
+			t.Fatalf("Expected lines %q, got %q", test.expected, lines)
+		}
+		for i, expected := range test.expected {
+			if lines[i] != expected {
+				t.Errorf("Expected line %d to be %q, got %q", i, expected, lines[i])
+			}
+		}
+
+		state := <-h.FinishChan
+		if state.Complete != test.complete {
+			t.Errorf("Expected complete to be %v, got %v", test.complete, state.Complete)
+		}
+		if test.complete && (last == nil || !last.complete || last.Offset != state.Offset) {
+			t.Errorf("Expected a final position event at offset %d, got %+v", state.Offset, last)
+		}
+	}
+}
+
+func TestFindOriginal(t *testing.T) {
+	plain := write_temp(t, []byte("one\ntwo\n"))
+	defer os.Remove(plain)
+	other := write_temp(t, []byte("other\n"))
+	defer os.Remove(other)
+	compressed := write_temp(t, gzip_lines("one\ntwo\nthree\n"))
+	defer os.Remove(compressed)
+
+	_, plain_fingerprint := check_fingerprint(plain, nil, 1024)
+	_, other_fingerprint := check_fingerprint(other, nil, 1024)
+	_, compressed_fingerprint := check_fingerprint(compressed, nil, 1024)
+	fingerprints := map[string]*Fingerprint{
+		plain:      plain_fingerprint,
+		other:      other_fingerprint,
+		compressed: compressed_fingerprint,
+	}
+	if original := find_original(compressed, fingerprints, 1024); original != plain {
+		t.Fatalf("Expected %s to be found as the original, got '%s'", plain, original)
+	}
+
+	delete(fingerprints, plain)
+	if original := find_original(compressed, fingerprints, 1024); original != "" {
+		t.Fatalf("Expected no original, got '%s'", original)
+	}
+}
+
+func TestProspectorStopKeepsComplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-prospector")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log.1.gz")
+	if err = ioutil.WriteFile(path, gzip_lines("one\ntwo\n"), 0644); err != nil {
+		testBug(err)
+	}
+
+	resume := &ProspectorResume{files: map[string]*FileState{}, persist: make(chan *FileState)}
+	go drain_persist(resume.persist)
+	output := make(chan *FileEvent, 10)
+	prospector := NewProspector(FileConfig{Paths: []string{filepath.Join(dir, "*.gz")}, Decompress: true, FingerprintBytes: 1024, deadtime: time.Hour})
+	go prospector.Prospect(resume, output)
+
+	for {
+		select {
+		case event := <-output:
+			if !event.complete {
+				continue
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the compressed file to be read")
+		}
+		break
+	}
+
+	// So another prospector skips it rather than reading it again
+	states := prospector.Stop()
+	if state, found := states[path]; !found || !state.Complete {
+		t.Errorf("expected %s to be complete, got %+v", path, state)
+	}
+}
@@ -2,18 +2,54 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"time"
 )
 
+const default_RegistryFile string = ".logstash-forwarder"
+
+const default_CleanAfter string = "24h"
+
 const default_NetworkConfig_Timeout int64 = 15
 
+const default_NetworkConfig_MaxPendingPayloads int = 4
+
+// How events are sent to servers
+const (
+  transport_tls = "tls"
+  transport_tcp = "tcp" /* plain text, for trusted networks and testing only */
+)
+
 const default_FileConfig_DeadTime string = "24h"
 
+const default_FileConfig_MaxLineBytes int = 1 << 20
+
+const default_FileConfig_ScanInterval string = "10s"
+
+const default_FileConfig_PollInterval string = "1s"
+
+const default_MultilineConfig_What string = "previous"
+
+const default_MultilineConfig_MaxLines uint64 = 500
+
+const default_MultilineConfig_Timeout string = "5s"
+
+const default_CodecConfig_LineKey string = "message"
+
+var output_name_re = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
 type Config struct {
 	Network NetworkConfig `json:network`
+  Outputs map[string]*NetworkConfig `json:"outputs"`
 	Files   []FileConfig  `json:files`
+  RegistryFile string `json:"registry file"`
+  CleanAfter string `json:"clean after"`
+  clean_after time.Duration
 }
 
 type NetworkConfig struct {
@@ -21,9 +57,24 @@ type NetworkConfig struct {
 	SSLCertificate string   `json:"ssl certificate"`
 	SSLKey         string   `json:"ssl key"`
 	SSLCA          string   `json:"ssl ca"`
+  SSLCADirectory string   `json:"ssl ca directory"`
+  SSLServerName  string   `json:"ssl server name"`
+  SSLMinVersion  string   `json:"ssl min version"`
+  SSLMaxVersion  string   `json:"ssl max version"`
+  SSLCipherSuites []string `json:"ssl cipher suites"`
+  SSLPins        []string `json:"ssl pinned sha256"`
+  tls_min_version uint16
+  tls_max_version uint16
+  tls_cipher_suites []uint16
+  tls_pins       [][]byte
   SSLStrict      bool     `json:"ssl strict verify"` // Stolen from https://github.com/elasticsearch/logstash-forwarder/issues/221
 	Timeout        int64    `json:timeout`
 	timeout        time.Duration
+	MaxPendingPayloads int  `json:"max pending payloads"`
+  Strategy       string   `json:"strategy"`
+  Transport      string   `json:"transport"`
+  BackoffConfig
+  name           string   /* of the output it configures, "" for "network" */
 }
 
 type FileConfig struct {
@@ -31,6 +82,94 @@ type FileConfig struct {
   Fields map[string]string `json:fields`
   DeadTime string `json:"dead time"`
   deadtime time.Duration
+  ScanInterval string `json:"scan interval"`
+  scan_interval time.Duration
+  PollInterval string `json:"poll interval"`
+  poll_interval time.Duration
+  Multiline *MultilineConfig `json:"multiline"`
+  IncludeLines []string `json:"include lines"`
+  ExcludeLines []string `json:"exclude lines"`
+  ExcludeFiles []string `json:"exclude files"`
+  MaxLineBytes int `json:"max line bytes"`
+  Encoding string `json:"encoding"`
+  Output string `json:"output"`
+  FingerprintBytes int `json:"fingerprint bytes"`
+  Decompress bool `json:"decompress"`
+  BackoffConfig
+  Codec *CodecConfig `json:"codec"`
+  include_lines []*regexp.Regexp
+  exclude_lines []*regexp.Regexp
+  exclude_files []*ExcludePattern
+  text_encoding *TextEncoding
+}
+
+type MultilineConfig struct {
+  Pattern  string `json:"pattern"`
+  Negate   bool   `json:"negate"`
+  What     string `json:"what"`
+  MaxLines uint64 `json:"max lines"`
+  Timeout  string `json:"timeout"`
+  pattern  *regexp.Regexp
+  timeout  time.Duration
+}
+
+type CodecConfig struct {
+  Type    string `json:"type"`
+  LineKey string `json:"line key"`
+  Flatten bool   `json:"flatten"`
+}
+
+func (n *NetworkConfig) init() error {
+  if n.Timeout == 0 {
+    n.Timeout = default_NetworkConfig_Timeout
+  }
+
+  n.timeout = time.Duration(n.Timeout) * time.Second
+
+  if n.MaxPendingPayloads <= 0 {
+    n.MaxPendingPayloads = default_NetworkConfig_MaxPendingPayloads
+  }
+
+  for _, server := range n.Servers {
+    if !hostport_re.MatchString(server) {
+      return fmt.Errorf("servers must be given as host:port, not '%s'", server)
+    }
+  }
+
+  if n.Strategy == "" {
+    n.Strategy = strategy_random
+  } else if !strategies[n.Strategy] {
+    return fmt.Errorf("strategy must be random, failover, round-robin or parallel, not '%s'", n.Strategy)
+  }
+
+  if n.Transport == "" {
+    n.Transport = transport_tls
+  } else if n.Transport != transport_tls && n.Transport != transport_tcp {
+    return fmt.Errorf("transport must be tls or tcp, not '%s'", n.Transport)
+  }
+  if err := n.init_tls(); err != nil {
+    return err
+  }
+  if n.Transport == transport_tcp {
+    log.Printf("WARNING: transport tcp: events will be sent to %v unencrypted, and the ssl settings are ignored\n", n.Servers)
+  }
+  return n.BackoffConfig.init()
+}
+
+// output_configs returns the network configuration of each output, by name.
+// Files that don't name an output use the "network" section, which is the
+// output named "".
+func (c *Config) output_configs() map[string]*NetworkConfig {
+  configs := make(map[string]*NetworkConfig, len(c.Outputs)+1)
+  for name, output := range c.Outputs {
+    configs[name] = output
+  }
+  for _, fileconfig := range c.Files {
+    if fileconfig.Output == "" {
+      configs[""] = &c.Network
+    }
+  }
+  return configs
 }
 
 func LoadConfig(path string) (config Config, err error) {
@@ -57,13 +196,77 @@ func LoadConfig(path string) (config Config, err error) {
 		return
 	}
 
-  if config.Network.Timeout == 0 {
-    config.Network.Timeout = default_NetworkConfig_Timeout
+  // The -registry-file flag overrides the config file. Relative paths are
+  // resolved now, so the registry doesn't move if the working directory does
+  if *registry_file != "" {
+    config.RegistryFile = *registry_file
+  }
+  if config.RegistryFile == "" {
+    config.RegistryFile = default_RegistryFile
+  }
+  config.RegistryFile, err = filepath.Abs(config.RegistryFile)
+  if err != nil {
+    log.Printf("Failed to find the registry file '%s': %s\n", config.RegistryFile, err)
+    return
+  }
+
+  if config.CleanAfter == "" {
+    config.CleanAfter = default_CleanAfter
+  }
+  config.clean_after, err = time.ParseDuration(config.CleanAfter)
+  if err != nil {
+    log.Printf("Failed to parse clean after duration '%s'. Error was: %s\n", config.CleanAfter, err)
+    return
   }
 
-	config.Network.timeout = time.Duration(config.Network.Timeout) * time.Second
+  err = config.Network.init()
+  if err != nil {
+    log.Printf("Invalid network configuration: %s\n", err)
+    return
+  }
+  for name, output := range config.Outputs {
+    if !output_name_re.MatchString(name) {
+      err = fmt.Errorf("output names may only use letters, digits, '-' and '_', not '%s'", name)
+      log.Printf("Invalid outputs: %s\n", err)
+      return
+    }
+    if output == nil || len(output.Servers) == 0 {
+      err = fmt.Errorf("no servers given for output '%s'", name)
+      log.Printf("Invalid outputs: %s\n", err)
+      return
+    }
+    err = output.init()
+    if err != nil {
+      log.Printf("Invalid configuration for output '%s': %s\n", name, err)
+      return
+    }
+    output.name = name
+  }
 
+  // Each path may only be given once, as prospectors are told apart by their
+  // paths when reloading
+  paths := make(map[string]bool)
+  warned_max_line_bytes := false
   for k, _ := range config.Files {
+    for _, path := range config.Files[k].Paths {
+      if paths[path] {
+        err = fmt.Errorf("'%s' is given in more than one files entry", path)
+        log.Printf("Invalid files: %s\n", err)
+        return
+      }
+      paths[path] = true
+    }
+
+    if output := config.Files[k].Output; output == "" && len(config.Network.Servers) == 0 {
+      err = fmt.Errorf("no servers given in \"network\" for %v, which doesn't name an output", config.Files[k].Paths)
+      log.Printf("Invalid files: %s\n", err)
+      return
+    } else if _, found := config.Outputs[output]; output != "" && !found {
+      err = fmt.Errorf("unknown output '%s' for %v", output, config.Files[k].Paths)
+      log.Printf("Invalid files: %s\n", err)
+      return
+    }
+
     if config.Files[k].DeadTime == "" {
       config.Files[k].DeadTime = default_FileConfig_DeadTime
     }
@@ -72,7 +275,187 @@ func LoadConfig(path string) (config Config, err error) {
       log.Printf("Failed to parse dead time duration '%s'. Error was: %s\n", config.Files[k].DeadTime, err)
       return
     }
+
+    if config.Files[k].ScanInterval == "" {
+      config.Files[k].ScanInterval = default_FileConfig_ScanInterval
+    }
+    config.Files[k].scan_interval, err = time.ParseDuration(config.Files[k].ScanInterval)
+    if err == nil && config.Files[k].scan_interval <= 0 {
+      err = errors.New("must be positive")
+    }
+    if err != nil {
+      log.Printf("Failed to parse scan interval '%s'. Error was: %s\n", config.Files[k].ScanInterval, err)
+      return
+    }
+
+    if config.Files[k].PollInterval == "" {
+      config.Files[k].PollInterval = default_FileConfig_PollInterval
+    }
+    config.Files[k].poll_interval, err = time.ParseDuration(config.Files[k].PollInterval)
+    if err == nil && config.Files[k].poll_interval <= 0 {
+      err = errors.New("must be positive")
+    }
+    if err != nil {
+      log.Printf("Failed to parse poll interval '%s'. Error was: %s\n", config.Files[k].PollInterval, err)
+      return
+    }
+
+    err = config.Files[k].BackoffConfig.init()
+    if err != nil {
+      log.Printf("Invalid files: %s\n", err)
+      return
+    }
+
+    if config.Files[k].MaxLineBytes <= 0 {
+      config.Files[k].MaxLineBytes = default_FileConfig_MaxLineBytes
+      // Lines used to be shipped whole however long they were, so say so
+      // when an older config picks up the limit without asking for it
+      if !warned_max_line_bytes {
+        log.Printf("WARNING: max line bytes is not set, lines longer than %d bytes will be truncated\n", default_FileConfig_MaxLineBytes)
+        warned_max_line_bytes = true
+      }
+    }
+
+    if config.Files[k].FingerprintBytes < 0 {
+      err = fmt.Errorf("fingerprint bytes must not be negative, got %d", config.Files[k].FingerprintBytes)
+      log.Printf("Invalid fingerprint bytes: %s\n", err)
+      return
+    }
+    if config.Files[k].Decompress && config.Files[k].FingerprintBytes == 0 {
+      // Without fingerprints a compressed rotation can't be linked to the
+      // file it was compressed from, and would be shipped all over again
+      err = fmt.Errorf("decompress needs fingerprint bytes to be set, for %v", config.Files[k].Paths)
+      log.Printf("Invalid files: %s\n", err)
+      return
+    }
+
+    if config.Files[k].Encoding != "" {
+      config.Files[k].text_encoding, err = NewTextEncoding(config.Files[k].Encoding)
+      if err != nil {
+        log.Printf("Invalid encoding: %s\n", err)
+        return
+      }
+    }
+
+    if config.Files[k].Multiline != nil {
+      err = config.Files[k].Multiline.init()
+      if err != nil {
+        log.Printf("Invalid multiline configuration: %s\n", err)
+        return
+      }
+    }
+
+    if config.Files[k].Codec != nil {
+      err = config.Files[k].Codec.init()
+      if err != nil {
+        log.Printf("Invalid codec configuration: %s\n", err)
+        return
+      }
+    }
+
+    config.Files[k].include_lines, err = compile_patterns(config.Files[k].IncludeLines)
+    if err != nil {
+      log.Printf("Invalid include lines: %s\n", err)
+      return
+    }
+    config.Files[k].exclude_lines, err = compile_patterns(config.Files[k].ExcludeLines)
+    if err != nil {
+      log.Printf("Invalid exclude lines: %s\n", err)
+      return
+    }
+    config.Files[k].exclude_files, err = compile_exclude_patterns(config.Files[k].ExcludeFiles)
+    if err != nil {
+      log.Printf("Invalid exclude files: %s\n", err)
+      return
+    }
   }
 
 	return
 }
+
+func compile_patterns(patterns []string) (compiled []*regexp.Regexp, err error) {
+  for _, pattern := range patterns {
+    re, err := regexp.Compile(pattern)
+    if err != nil {
+      return nil, fmt.Errorf("failed to compile pattern '%s': %s", pattern, err)
+    }
+    compiled = append(compiled, re)
+  }
+  return
+}
+
+// ShouldShip reports whether a line passes the include and exclude lines
+// filters. If any include lines are given the line must match one of them,
+// and it must not match any exclude lines.
+func (f *FileConfig) ShouldShip(text string) bool {
+  if len(f.include_lines) > 0 {
+    included := false
+    for _, re := range f.include_lines {
+      if re.MatchString(text) {
+        included = true
+        break
+      }
+    }
+    if !included {
+      return false
+    }
+  }
+
+  for _, re := range f.exclude_lines {
+    if re.MatchString(text) {
+      return false
+    }
+  }
+  return true
+}
+
+// IsExcluded reports whether a file matched by the paths should be skipped
+// because it matches one of the exclude files patterns.
+func (f *FileConfig) IsExcluded(path string) bool {
+  for _, pattern := range f.exclude_files {
+    if pattern.Match(path) {
+      return true
+    }
+  }
+  return false
+}
+
+func (m *MultilineConfig) init() (err error) {
+  if m.Pattern == "" {
+    return errors.New("a pattern is required")
+  }
+  m.pattern, err = regexp.Compile(m.Pattern)
+  if err != nil {
+    return fmt.Errorf("failed to compile pattern '%s': %s", m.Pattern, err)
+  }
+
+  if m.What == "" {
+    m.What = default_MultilineConfig_What
+  }
+  if m.What != "previous" && m.What != "next" {
+    return fmt.Errorf("what must be 'previous' or 'next', not '%s'", m.What)
+  }
+
+  if m.MaxLines == 0 {
+    m.MaxLines = default_MultilineConfig_MaxLines
+  }
+
+  if m.Timeout == "" {
+    m.Timeout = default_MultilineConfig_Timeout
+  }
+  m.timeout, err = time.ParseDuration(m.Timeout)
+  if err != nil {
+    return fmt.Errorf("failed to parse timeout duration '%s': %s", m.Timeout, err)
+  }
+  return nil
+}
+
+func (c *CodecConfig) init() error {
+  if c.Type != "json" {
+    return fmt.Errorf("type must be 'json', not '%s'", c.Type)
+  }
+  if c.LineKey == "" {
+    c.LineKey = default_CodecConfig_LineKey
+  }
+  return nil
+}
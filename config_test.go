@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 // -------------------------------------------------------------------
@@ -111,6 +115,29 @@ func TestLoadConfig(t *testing.T) {
 	}
 }
 
+// Both files in the sample config leave out max line bytes, which should be
+// defaulted with a single warning
+func TestLoadConfigMaxLineBytesDefault(t *testing.T) {
+	fname := writeConfFile([]byte(configJson))
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	config, e := LoadConfig(fname)
+	if e != nil {
+		t.Fatalf("filename:%s - error: %s", fname, e)
+	}
+	for i := range config.Files {
+		if config.Files[i].MaxLineBytes != default_FileConfig_MaxLineBytes {
+			t.Errorf("Expected max line bytes %d for files %d, got %d", default_FileConfig_MaxLineBytes, i, config.Files[i].MaxLineBytes)
+		}
+	}
+	if n := strings.Count(logged.String(), "max line bytes is not set"); n != 1 {
+		t.Errorf("Expected one max line bytes warning, got %d in %q", n, logged.String())
+	}
+}
+
 // -------------------------------------------------------------------
 // test support funcs
 // -------------------------------------------------------------------
@@ -125,3 +152,101 @@ func writeConfFile(data []byte) string {
 
 // call on test setup failure.
 func testBug(e error) { panic("TESTBUG: " + e.Error()) }
+
+func TestShouldShip(t *testing.T) {
+	fname := writeConfFile([]byte(`{
+  "network": { "servers": [ "localhost:5043" ] },
+  "files": [ {
+    "paths": [ "/var/log/app.log" ],
+    "include lines": [ "^ERROR", "^WARN" ],
+    "exclude lines": [ "healthcheck" ]
+  } ]
+}`))
+	config, e := LoadConfig(fname)
+	if e != nil {
+		t.Fatalf("filename:%s - error: %s", fname, e)
+	}
+
+	fileconfig := &config.Files[0]
+	for text, expected := range map[string]bool{
+		"ERROR failed to connect":  true,
+		"WARN slow request":        true,
+		"DEBUG connecting":         false,
+		"WARN healthcheck timeout": false,
+	} {
+		if fileconfig.ShouldShip(text) != expected {
+			t.Errorf("ShouldShip(%q) should be %v", text, expected)
+		}
+	}
+}
+
+func TestLoadConfigOutputs(t *testing.T) {
+	fname := writeConfFile([]byte(`{
+  "outputs": {
+    "security": { "servers": [ "security:5043" ], "timeout": 30 },
+    "app": { "servers": [ "app:5043" ] }
+  },
+  "files": [
+    { "paths": [ "/var/log/auth.log" ], "output": "security" },
+    { "paths": [ "/var/log/app.log" ], "output": "app" }
+  ]
+}`))
+	config, e := LoadConfig(fname)
+	if e != nil {
+		t.Fatalf("filename:%s - error: %s", fname, e)
+	}
+
+	networks := config.output_configs()
+	if len(networks) != 2 {
+		t.Fatalf("Expected only the named outputs, got %v", networks)
+	}
+	if networks["security"].timeout != 30*time.Second || networks["app"].timeout != time.Duration(default_NetworkConfig_Timeout)*time.Second {
+		t.Errorf("Expected output timeouts of 30s and the default, got %v and %v", networks["security"].timeout, networks["app"].timeout)
+	}
+	if networks["app"].MaxPendingPayloads != default_NetworkConfig_MaxPendingPayloads {
+		t.Errorf("Expected the default max pending payloads, got %d", networks["app"].MaxPendingPayloads)
+	}
+
+	for _, invalid := range []string{
+		// Unknown output
+		`{ "outputs": { "app": { "servers": [ "app:5043" ] } }, "files": [ { "paths": [ "/a" ], "output": "other" } ] }`,
+		// An output without servers
+		`{ "outputs": { "app": { } }, "files": [ { "paths": [ "/a" ], "output": "app" } ] }`,
+		// No output named and no "network" servers
+		`{ "outputs": { "app": { "servers": [ "app:5043" ] } }, "files": [ { "paths": [ "/a" ] } ] }`,
+		// Names are used for disk spool directories
+		`{ "outputs": { "../app": { "servers": [ "app:5043" ] } }, "files": [ { "paths": [ "/a" ], "output": "../app" } ] }`,
+		// The same path in two files entries
+		`{ "outputs": { "app": { "servers": [ "app:5043" ] } }, "files": [ { "paths": [ "/a" ], "output": "app" }, { "paths": [ "/b", "/a" ], "output": "app" } ] }`,
+	} {
+		if _, e := LoadConfig(writeConfFile([]byte(invalid))); e == nil {
+			t.Errorf("Expected an error loading %s", invalid)
+		}
+	}
+}
+
+func TestLoadConfigNetwork(t *testing.T) {
+	fname := writeConfFile([]byte(`{
+  "network": { "servers": [ "localhost:5043" ], "transport": "tcp", "strategy": "failover" },
+  "files": [ { "paths": [ "/var/log/app.log" ] } ]
+}`))
+	config, e := LoadConfig(fname)
+	if e != nil {
+		t.Fatalf("filename:%s - error: %s", fname, e)
+	}
+	if config.Network.Transport != transport_tcp || config.Network.Strategy != strategy_failover {
+		t.Errorf("Expected the tcp transport and failover, got %s and %s", config.Network.Transport, config.Network.Strategy)
+	}
+
+	for _, invalid := range []string{
+		`{ "network": { "servers": [ "localhost:5043" ], "transport": "udp" }, "files": [ { "paths": [ "/a" ] } ] }`,
+		`{ "network": { "servers": [ "localhost:5043" ], "strategy": "fastest" }, "files": [ { "paths": [ "/a" ] } ] }`,
+		`{ "network": { "servers": [ "localhost:5043", "localhost" ] }, "files": [ { "paths": [ "/a" ] } ] }`,
+		// Decompressed rotations can't be told apart without fingerprints
+		`{ "network": { "servers": [ "localhost:5043" ] }, "files": [ { "paths": [ "/a" ], "decompress": true } ] }`,
+	} {
+		if _, e := LoadConfig(writeConfFile([]byte(invalid))); e == nil {
+			t.Errorf("Expected an error loading %s", invalid)
+		}
+	}
+}
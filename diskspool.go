@@ -0,0 +1,403 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "sort"
+  "sync"
+  "time"
+)
+
+// A DiskSpool is a persistent queue of events that sits between the spooler
+// and the publisher. Events are appended to segment files, one JSON record
+// per line, and handed to the registrar once they are on disk. The read
+// position that has been acknowledged by the server is kept in a cursor file
+// so unacknowledged events are published again after a restart.
+type DiskSpool struct {
+  path         string
+  max_size     int64
+  segment_size int64
+
+  mutex sync.Mutex
+  cond  *sync.Cond
+
+  segments []uint64 /* ids of the segment files on disk, oldest first */
+  size     int64    /* total bytes in the segment files */
+
+  write_file    *os.File
+  write_segment uint64
+  write_offset  int64
+
+  read_segment uint64
+  read_offset  int64
+
+  ack DiskSpoolPosition
+  in_flight []DiskSpoolPosition /* end position of each event handed to the publisher */
+}
+
+type DiskSpoolPosition struct {
+  Segment uint64 `json:"segment"`
+  Offset  int64  `json:"offset"`
+}
+
+func OpenDiskSpool(path string, max_size int64, segment_size int64) (*DiskSpool, error) {
+  if segment_size <= 0 || max_size < 2*segment_size {
+    return nil, fmt.Errorf("disk spool size (%d) must be at least twice the segment size (%d)", max_size, segment_size)
+  }
+
+  err := os.MkdirAll(path, 0750)
+  if err != nil {
+    return nil, err
+  }
+
+  s := &DiskSpool{path: path, max_size: max_size, segment_size: segment_size}
+  s.cond = sync.NewCond(&s.mutex)
+
+  data, err := ioutil.ReadFile(s.cursor_path())
+  if err == nil {
+    if err = json.Unmarshal(data, &s.ack); err != nil {
+      return nil, fmt.Errorf("failed to decode %s: %s", s.cursor_path(), err)
+    }
+  } else if !os.IsNotExist(err) {
+    return nil, err
+  }
+
+  names, err := filepath.Glob(filepath.Join(path, "*.segment"))
+  if err != nil {
+    return nil, err
+  }
+  for _, name := range names {
+    var id uint64
+    if _, err := fmt.Sscanf(filepath.Base(name), "%d.segment", &id); err != nil {
+      continue
+    }
+    if id < s.ack.Segment {
+      // Fully acknowledged before we last stopped
+      os.Remove(name)
+      continue
+    }
+    info, err := os.Stat(name)
+    if err != nil {
+      return nil, err
+    }
+    s.segments = append(s.segments, id)
+    s.size += info.Size()
+  }
+  sort.Sort(segmentIds(s.segments))
+
+  // Append to the newest segment, or start the first one
+  s.write_segment = s.ack.Segment
+  if len(s.segments) > 0 {
+    s.write_segment = s.segments[len(s.segments)-1]
+  }
+  s.write_file, err = os.OpenFile(s.segment_path(s.write_segment), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+  if err != nil {
+    return nil, err
+  }
+  if len(s.segments) == 0 {
+    s.segments = append(s.segments, s.write_segment)
+  }
+  info, err := s.write_file.Stat()
+  if err != nil {
+    return nil, err
+  }
+  s.write_offset, err = complete_records(s.write_file)
+  if err != nil {
+    return nil, err
+  }
+  // Drop a partial record left behind if we stopped in the middle of a write
+  if s.write_offset < info.Size() {
+    if err = s.write_file.Truncate(s.write_offset); err != nil {
+      return nil, err
+    }
+    s.size -= info.Size() - s.write_offset
+  }
+
+  s.read_segment, s.read_offset = s.ack.Segment, s.ack.Offset
+
+  log.Printf("Opened disk spool %s with %d bytes in %d segments\n", path, s.size, len(s.segments))
+  return s, nil
+}
+
+// Write appends each batch of events to the spool and, once it has been
+// synced to disk, passes it on to the registrar.
+func (s *DiskSpool) Write(input chan []*FileEvent, registrar chan []*FileEvent) {
+  var buffer bytes.Buffer
+
+  for events := range input {
+    buffer.Reset()
+    spooled := make([]*FileEvent, 0, len(events))
+    for _, event := range events {
+      if err := encode_record(&buffer, event); err != nil {
+        log.Printf("Dropping event from %s at offset %d that can't be written to disk spool %s: %s\n", *event.Source, event.Offset, s.path, err)
+        continue
+      }
+      spooled = append(spooled, event)
+    }
+    if len(spooled) == 0 {
+      continue
+    }
+
+    s.mutex.Lock()
+    for s.size >= s.max_size {
+      log.Printf("Disk spool %s is full (%d bytes), waiting for acknowledgements\n", s.path, s.size)
+      s.cond.Wait()
+    }
+
+    for {
+      err := s.append(buffer.Bytes())
+      if err == nil {
+        break
+      }
+      log.Printf("Failed writing to disk spool %s, will retry: %s\n", s.path, err)
+      s.mutex.Unlock()
+      time.Sleep(1 * time.Second)
+      s.mutex.Lock()
+    }
+    s.cond.Broadcast()
+    s.mutex.Unlock()
+
+    // The events are durable now, so the registrar can move on
+    registrar <- spooled
+  }
+
+  // Anything not yet published is safe on disk for the next run
+  close(registrar)
+}
+
+// Read hands batches of up to max_size events to the publisher, waiting for
+// more events to be written when it has caught up.
+func (s *DiskSpool) Read(output chan []*FileEvent, max_size uint64) {
+  for {
+    s.mutex.Lock()
+    for s.read_segment == s.write_segment && s.read_offset >= s.write_offset {
+      s.cond.Wait()
+    }
+    segment, offset := s.read_segment, s.read_offset
+    limit := s.write_offset
+    if segment != s.write_segment {
+      limit = -1
+    }
+    s.mutex.Unlock()
+
+    events, ends, next, err := s.read(segment, offset, limit, max_size)
+    if err != nil {
+      log.Printf("Failed reading from disk spool %s, will retry: %s\n", s.path, err)
+      time.Sleep(1 * time.Second)
+      continue
+    }
+
+    s.mutex.Lock()
+    if next == offset {
+      // Nothing left to read here. If the segment is finished move on to the
+      // next one, otherwise wait for more to be written to it
+      if segment != s.write_segment {
+        s.read_segment, s.read_offset = s.next_segment(segment), 0
+      }
+      s.mutex.Unlock()
+      continue
+    }
+    // Past any corrupt records too, so they aren't read again
+    s.read_offset = next
+    s.in_flight = append(s.in_flight, ends...)
+    s.mutex.Unlock()
+
+    if len(events) == 0 {
+      continue
+    }
+
+    output <- events
+  }
+}
+
+// Acknowledge records events the server has acknowledged as consumed and
+// removes segments that are no longer needed.
+func (s *DiskSpool) Acknowledge(input chan []*FileEvent) {
+  for events := range input {
+    if len(events) == 0 {
+      continue
+    }
+
+    s.mutex.Lock()
+    if len(events) > len(s.in_flight) {
+      log.Printf("Disk spool %s received an ack for %d events but only %d are in flight\n", s.path, len(events), len(s.in_flight))
+      s.mutex.Unlock()
+      continue
+    }
+    s.ack = s.in_flight[len(events)-1]
+    s.in_flight = s.in_flight[len(events):]
+
+    err := s.write_cursor()
+    if err != nil {
+      log.Printf("Failed to save disk spool cursor %s: %s\n", s.cursor_path(), err)
+    }
+
+    for len(s.segments) > 1 && s.segments[0] < s.ack.Segment {
+      name := s.segment_path(s.segments[0])
+      if info, err := os.Stat(name); err == nil {
+        s.size -= info.Size()
+      }
+      os.Remove(name)
+      s.segments = s.segments[1:]
+    }
+    s.cond.Broadcast()
+    s.mutex.Unlock()
+  }
+}
+
+// append must be called with the mutex held.
+func (s *DiskSpool) append(data []byte) (err error) {
+  if s.write_offset >= s.segment_size {
+    var file *os.File
+    file, err = os.OpenFile(s.segment_path(s.write_segment+1), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+    if err != nil {
+      return
+    }
+    s.write_file.Close()
+    s.write_file = file
+    s.write_segment++
+    s.write_offset = 0
+    s.segments = append(s.segments, s.write_segment)
+  }
+
+  n, err := s.write_file.Write(data)
+  if err != nil {
+    // Drop whatever part of the batch made it to disk
+    s.write_file.Truncate(s.write_offset)
+    return
+  }
+  if err = s.write_file.Sync(); err != nil {
+    s.write_file.Truncate(s.write_offset)
+    return
+  }
+
+  s.write_offset += int64(n)
+  s.size += int64(n)
+  return
+}
+
+// read decodes up to max_size events from the segment starting at offset
+// and stopping at limit, or at the end of the file if limit is negative. It
+// also returns the offset after the last record it consumed, including any
+// corrupt records it skipped.
+func (s *DiskSpool) read(segment uint64, offset int64, limit int64, max_size uint64) (events []*FileEvent, ends []DiskSpoolPosition, next int64, err error) {
+  file, err := os.Open(s.segment_path(segment))
+  if err != nil {
+    return
+  }
+  defer file.Close()
+
+  if _, err = file.Seek(offset, os.SEEK_SET); err != nil {
+    return
+  }
+  var source io.Reader = file
+  if limit >= 0 {
+    source = io.LimitReader(file, limit-offset)
+  }
+  reader := bufio.NewReader(source)
+
+  for uint64(len(events)) < max_size {
+    record, err := reader.ReadBytes('\n')
+    if err == io.EOF {
+      // A partial record at the end of a segment was never acknowledged to
+      // the registrar, so it is skipped
+      break
+    } else if err != nil {
+      return nil, nil, 0, err
+    }
+    offset += int64(len(record))
+
+    event := &FileEvent{}
+    if err := json.Unmarshal(record, event); err != nil {
+      log.Printf("Skipping corrupt record in disk spool segment %s: %s\n", s.segment_path(segment), err)
+      continue
+    }
+    if event.Fields == nil {
+      event.Fields = &map[string]string{}
+    }
+    events = append(events, event)
+    ends = append(ends, DiskSpoolPosition{Segment: segment, Offset: offset})
+  }
+  return events, ends, offset, nil
+}
+
+// encode_record appends an event to the buffer as a record, leaving the
+// buffer as it was if the event can't be encoded.
+func encode_record(buffer *bytes.Buffer, event *FileEvent) error {
+  length := buffer.Len()
+  if err := json.NewEncoder(buffer).Encode(event); err != nil {
+    buffer.Truncate(length)
+    return err
+  }
+  return nil
+}
+
+// complete_records returns the length of the file up to the end of the last
+// complete record.
+func complete_records(file *os.File) (int64, error) {
+  if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+    return 0, err
+  }
+  reader := bufio.NewReader(file)
+
+  var length int64
+  for {
+    record, err := reader.ReadBytes('\n')
+    if err == io.EOF {
+      return length, nil
+    } else if err != nil {
+      return 0, err
+    }
+    length += int64(len(record))
+  }
+}
+
+// next_segment must be called with the mutex held.
+func (s *DiskSpool) next_segment(segment uint64) uint64 {
+  for _, id := range s.segments {
+    if id > segment {
+      return id
+    }
+  }
+  return s.write_segment
+}
+
+// write_cursor must be called with the mutex held.
+func (s *DiskSpool) write_cursor() error {
+  tmp := s.cursor_path() + ".new"
+  file, err := os.Create(tmp)
+  if err != nil {
+    return err
+  }
+
+  err = json.NewEncoder(file).Encode(&s.ack)
+  if err == nil {
+    err = file.Sync()
+  }
+  file.Close()
+  if err != nil {
+    return err
+  }
+  return os.Rename(tmp, s.cursor_path())
+}
+
+func (s *DiskSpool) cursor_path() string {
+  return filepath.Join(s.path, "cursor")
+}
+
+func (s *DiskSpool) segment_path(id uint64) string {
+  return filepath.Join(s.path, fmt.Sprintf("%020d.segment", id))
+}
+
+type segmentIds []uint64
+
+func (ids segmentIds) Len() int           { return len(ids) }
+func (ids segmentIds) Less(i, j int) bool { return ids[i] < ids[j] }
+func (ids segmentIds) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
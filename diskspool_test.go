@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func diskSpoolEvents(texts ...string) (events []*FileEvent) {
+	for i, text := range texts {
+		source, text := "test.log", text
+		events = append(events, &FileEvent{
+			Source:    &source,
+			Offset:    int64(i * 10),
+			Text:      &text,
+			RawLength: 10,
+			Fields:    &map[string]string{"type": "test"},
+		})
+	}
+	return
+}
+
+func receiveBatch(t *testing.T, output chan []*FileEvent) []*FileEvent {
+	select {
+	case events := <-output:
+		return events
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for events from the disk spool")
+	}
+	return nil
+}
+
+func TestDiskSpoolReplaysUnacknowledged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-spool")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenDiskSpool(dir, 1<<20, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := make(chan []*FileEvent, 1)
+	registrar := make(chan []*FileEvent, 1)
+	output := make(chan []*FileEvent, 1)
+	acks := make(chan []*FileEvent, 1)
+	go spool.Write(input, registrar)
+	go spool.Read(output, 2)
+	go spool.Acknowledge(acks)
+
+	input <- diskSpoolEvents("one", "two", "three")
+	if events := <-registrar; len(events) != 3 {
+		t.Fatalf("expected 3 durable events, got %d", len(events))
+	}
+
+	first := receiveBatch(t, output)
+	if len(first) != 2 || *first[0].Text != "one" || (*first[1].Fields)["type"] != "test" {
+		t.Fatalf("unexpected first batch: %d events", len(first))
+	}
+	acks <- first[:1]
+
+	// Wait for the ack to be recorded before reopening
+	second := receiveBatch(t, output)
+	if len(second) != 1 || *second[0].Text != "three" {
+		t.Fatalf("unexpected second batch: %d events", len(second))
+	}
+	acks <- first[1:2]
+	time.Sleep(100 * time.Millisecond)
+
+	reopened, err := OpenDiskSpool(dir, 1<<20, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := make(chan []*FileEvent, 1)
+	go reopened.Read(replay, 10)
+
+	events := receiveBatch(t, replay)
+	if len(events) != 1 || *events[0].Text != "three" {
+		t.Fatalf("expected only the unacknowledged event to be replayed, got %d", len(events))
+	}
+}
+
+func TestDiskSpoolSizeValidation(t *testing.T) {
+	if _, err := OpenDiskSpool(os.TempDir(), 100, 100); err == nil {
+		t.Errorf("expected a spool smaller than two segments to be rejected")
+	}
+}
+
+func TestDiskSpoolSkipsCorruptRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-spool")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A valid record followed by a corrupt one, in the segment being written
+	spool, err := OpenDiskSpool(dir, 1<<20, 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := make(chan []*FileEvent, 1)
+	registrar := make(chan []*FileEvent, 1)
+	go spool.Write(input, registrar)
+	input <- diskSpoolEvents("one")
+	<-registrar
+	spool.mutex.Lock()
+	if err := spool.append([]byte("{not json\n")); err != nil {
+		testBug(err)
+	}
+	spool.cond.Broadcast()
+	spool.mutex.Unlock()
+
+	output := make(chan []*FileEvent, 10)
+	go spool.Read(output, 10)
+	if events := receiveBatch(t, output); len(events) != 1 || *events[0].Text != "one" {
+		t.Fatalf("expected the valid event, got %d events", len(events))
+	}
+
+	// The corrupt record isn't read again, and later events still arrive
+	input <- diskSpoolEvents("two")
+	<-registrar
+	if events := receiveBatch(t, output); len(events) != 1 || *events[0].Text != "two" {
+		t.Fatalf("expected only the next event, got %d events", len(events))
+	}
+	select {
+	case events := <-output:
+		t.Fatalf("expected nothing more, got %d events", len(events))
+	case <-time.After(200 * time.Millisecond):
+	}
+}
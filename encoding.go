@@ -0,0 +1,102 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "unicode/utf8"
+
+  "golang.org/x/text/encoding"
+  "golang.org/x/text/encoding/charmap"
+  "golang.org/x/text/encoding/htmlindex"
+)
+
+// TextEncoding is the character encoding of a file. Lines are split on the
+// raw bytes, so offsets stay byte positions in the file, and each line is
+// decoded into UTF-8 once it is complete.
+type TextEncoding struct {
+  name       string
+  encoding   encoding.Encoding /* nil for UTF-8, which is passed through as is */
+  unit       int               /* bytes per code unit, 2 for UTF-16 */
+  big_endian bool
+}
+
+// NewTextEncoding looks up an encoding by any of its WHATWG labels, such as
+// "utf-16le", "shift_jis" or "windows-1252". "latin1" and "iso-8859-1" mean
+// ISO 8859-1 itself rather than the windows-1252 superset.
+func NewTextEncoding(name string) (*TextEncoding, error) {
+  switch strings.ToLower(name) {
+  case "latin1", "latin-1", "iso-8859-1", "iso8859-1":
+    return &TextEncoding{name: "iso-8859-1", encoding: charmap.ISO8859_1, unit: 1}, nil
+  }
+
+  enc, err := htmlindex.Get(name)
+  if err != nil {
+    return nil, fmt.Errorf("unknown encoding '%s'", name)
+  }
+  canonical, _ := htmlindex.Name(enc)
+
+  e := &TextEncoding{name: canonical, encoding: enc, unit: 1}
+  switch canonical {
+  case "utf-8":
+    e.encoding = nil
+  case "utf-16le":
+    e.unit = 2
+  case "utf-16be":
+    e.unit = 2
+    e.big_endian = true
+  }
+  return e, nil
+}
+
+func (e *TextEncoding) unit_size() int {
+  if e == nil {
+    return 1
+  }
+  return e.unit
+}
+
+// line_end returns the length of the EOL chars (LF or CRLF) ending a line of
+// length bytes whose last four bytes are tail, or 0 if the line hasn't ended.
+func (e *TextEncoding) line_end(tail [4]byte, length int) int {
+  if e.unit_size() == 1 {
+    if length < 1 || tail[3] != '\n' {
+      return 0
+    }
+    if length > 1 && tail[2] == '\r' {
+      return 2
+    }
+    return 1
+  }
+
+  lf, cr := [2]byte{'\n', 0}, [2]byte{'\r', 0}
+  if e.big_endian {
+    lf, cr = [2]byte{0, '\n'}, [2]byte{0, '\r'}
+  }
+  if length < 2 || length%2 != 0 || tail[2] != lf[0] || tail[3] != lf[1] {
+    return 0
+  }
+  if length > 3 && tail[0] == cr[0] && tail[1] == cr[1] {
+    return 4
+  }
+  return 2
+}
+
+// needs_next_byte reports whether the line ends in an LF byte that may be the
+// first half of a UTF-16LE newline, so the next byte must be read on its own
+// to find out.
+func (e *TextEncoding) needs_next_byte(tail [4]byte, length int) bool {
+  return e.unit_size() == 2 && !e.big_endian && length%2 == 1 && tail[3] == '\n'
+}
+
+// trim_partial_rune drops a UTF-8 character cut short at the end of raw.
+func trim_partial_rune(raw []byte) []byte {
+  for i := len(raw) - 1; i >= 0 && i >= len(raw)-utf8.UTFMax; i-- {
+    if utf8.RuneStart(raw[i]) {
+      if !utf8.FullRune(raw[i:]) {
+        return raw[:i]
+      }
+      break
+    }
+  }
+  return raw
+}
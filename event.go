@@ -3,11 +3,25 @@ package main
 import "os"
 
 type FileEvent struct {
-  Source *string `json:"source,omitempty"`
-  Offset int64   `json:"offset,omitempty"`
-  Line   uint64  `json:"line,omitempty"`
-  Text   *string `json:"text,omitempty"`
-  Fields *map[string]string
+  Source    *string `json:"source,omitempty"`
+  Offset    int64   `json:"offset,omitempty"`
+  Line      uint64  `json:"line,omitempty"` /* 0 if unknown */
+  LastLine  uint64  `json:"last_line,omitempty"` /* the number of the last line, if there are several */
+  Text      *string `json:"text,omitempty"`
+  RawLength int64   `json:"raw_length,omitempty"` /* bytes read from the file, including EOL chars */
+  Truncated bool    `json:"truncated,omitempty"` /* text was cut at max line bytes */
+  Fields    *map[string]string
+  Decoded   map[string]string `json:"decoded,omitempty"` /* fields decoded from the text by a codec */
 
   fileinfo *os.FileInfo
+  fingerprint *Fingerprint
+  complete bool /* the last event of a compressed file */
+}
+
+// last_line returns the number of the last line read for the event.
+func (e *FileEvent) last_line() uint64 {
+  if e.LastLine > e.Line {
+    return e.LastLine
+  }
+  return e.Line
 }
@@ -3,6 +3,9 @@ package main
 type FileState struct {
   Source *string `json:"source,omitempty"`
   Offset int64   `json:"offset,omitempty"`
+  Line   uint64  `json:"line,omitempty"` /* the number of the line ending at Offset, 0 if unknown */
   Inode  uint64  `json:"inode,omitempty"`
   Device int32   `json:"device,omitempty"`
+  Fingerprint *Fingerprint `json:"fingerprint,omitempty"` /* of the start of the file, if fingerprint bytes is set */
+  Complete bool `json:"complete,omitempty"` /* a compressed file that has been read to its end */
 }
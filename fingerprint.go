@@ -0,0 +1,106 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "io"
+  "io/ioutil"
+  "os"
+)
+
+// A Fingerprint identifies a file by a hash of its first bytes, so a new file
+// that reuses an old file's inode, or a file truncated and rewritten in
+// place, isn't mistaken for the file we saw before. Files shorter than the
+// configured fingerprint bytes are hashed in full, and their fingerprint is
+// extended as they grow. Compressed files are fingerprinted by their
+// decompressed content, so they match the file they were compressed from.
+type Fingerprint struct {
+  Size int64  `json:"size"` /* bytes hashed */
+  Hash string `json:"hash"` /* hex SHA-256 */
+}
+
+// NewFingerprint hashes the start of a file.
+func NewFingerprint(start []byte) *Fingerprint {
+  hash := sha256.Sum256(start)
+  return &Fingerprint{Size: int64(len(start)), Hash: hex.EncodeToString(hash[:])}
+}
+
+// Matches reports whether the start of a file is what the fingerprint was
+// taken of.
+func (f *Fingerprint) Matches(start []byte) bool {
+  if int64(len(start)) < f.Size {
+    return false
+  }
+  return *NewFingerprint(start[:f.Size]) == *f
+}
+
+// read_start reads up to size bytes of content from the start of a file,
+// decompressing it if it is compressed. Whatever could be decompressed of a
+// compressed file that is still being written is returned.
+func read_start(file io.ReaderAt, size int64) ([]byte, error) {
+  var reader io.Reader = io.NewSectionReader(file, 0, 1<<62)
+  compression := detect_compression(file, "")
+  if compression != compression_none {
+    decompressed, err := decompress(reader, compression)
+    if err != nil {
+      return nil, err
+    }
+    reader = decompressed
+  }
+
+  start, err := ioutil.ReadAll(io.LimitReader(reader, size))
+  if err != nil && compression != compression_none && len(start) > 0 {
+    err = nil
+  }
+  return start, err
+}
+
+// match_fingerprint reports whether a file still starts with the content a
+// fingerprint was taken of, and returns the fingerprint of the file as it is
+// now, which covers more of the file if it has grown. A missing fingerprint
+// always matches, as there is nothing to go on but the inode.
+func match_fingerprint(file io.ReaderAt, fingerprint *Fingerprint, size int64) (bool, *Fingerprint) {
+  if size <= 0 {
+    return true, nil
+  }
+
+  start, err := read_start(file, size)
+  if err != nil {
+    return fingerprint == nil, nil
+  }
+  current := NewFingerprint(start)
+  if fingerprint == nil {
+    return true, current
+  }
+  if !fingerprint.Matches(start) {
+    return false, current
+  }
+  if current.Size > fingerprint.Size {
+    return true, current
+  }
+  return true, fingerprint
+}
+
+// check_fingerprint is match_fingerprint for the file at path.
+func check_fingerprint(path string, fingerprint *Fingerprint, size int64) (bool, *Fingerprint) {
+  if size <= 0 {
+    return true, nil
+  }
+  file, err := os.Open(path)
+  if err != nil {
+    return fingerprint == nil, nil
+  }
+  defer file.Close()
+  return match_fingerprint(file, fingerprint, size)
+}
+
+// is_fingerprint_same reports whether a file still starts with the content
+// its saved state was fingerprinted from. State without a fingerprint always
+// matches.
+func is_fingerprint_same(path string, state *FileState) bool {
+  if state.Fingerprint == nil {
+    return true
+  }
+  matches, _ := check_fingerprint(path, state.Fingerprint, state.Fingerprint.Size)
+  return matches
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatchFingerprint(t *testing.T) {
+	file, err := ioutil.TempFile("", "logstash-forwarder-fingerprint")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	file.WriteString("short\n")
+	matches, fingerprint := match_fingerprint(file, nil, 16)
+	if !matches || fingerprint == nil || fingerprint.Size != 6 {
+		t.Fatalf("Expected a 6 byte fingerprint of a new file, got %v, %+v", matches, fingerprint)
+	}
+
+	// Growing the file extends the fingerprint up to the limit
+	file.WriteString("and now much longer\n")
+	matches, grown := match_fingerprint(file, fingerprint, 16)
+	if !matches || grown.Size != 16 {
+		t.Fatalf("Expected a grown file to match with a 16 byte fingerprint, got %v, %+v", matches, grown)
+	}
+	if matches, same := match_fingerprint(file, grown, 16); !matches || same != grown {
+		t.Fatalf("Expected a full fingerprint to match unchanged, got %v, %+v", matches, same)
+	}
+
+	// Rewriting the start, as with copy and truncate, does not match
+	file.Truncate(0)
+	file.WriteAt([]byte("other content, long enough\n"), 0)
+	if matches, _ := match_fingerprint(file, grown, 16); matches {
+		t.Fatalf("Expected rewritten content not to match")
+	}
+	if matches, _ := match_fingerprint(file, fingerprint, 16); matches {
+		t.Fatalf("Expected rewritten content not to match a short fingerprint")
+	}
+
+	// Nothing to compare with fingerprints disabled
+	if matches, disabled := match_fingerprint(file, grown, 0); !matches || disabled != nil {
+		t.Fatalf("Expected disabled fingerprints to match, got %v, %+v", matches, disabled)
+	}
+}
+
+func TestCalculateResumeFingerprint(t *testing.T) {
+	file, err := ioutil.TempFile("", "logstash-forwarder-fingerprint")
+	if err != nil {
+		testBug(err)
+	}
+	path := file.Name()
+	defer os.Remove(path)
+	file.WriteString("first line\nsecond line\n")
+	file.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		testBug(err)
+	}
+	ino, dev := file_ids(&info)
+	_, fingerprint := check_fingerprint(path, nil, 1024)
+	state := &FileState{Source: &path, Offset: 11, Line: 1, Inode: ino, Device: dev, Fingerprint: fingerprint}
+
+	p := NewProspector(FileConfig{FingerprintBytes: 1024})
+	resume := &ProspectorResume{files: map[string]*FileState{path: state}, persist: make(chan *FileState, 2)}
+	if resumed := p.calculate_resume(path, info, resume); resumed == nil || resumed.Offset != 11 || resumed.Line != 1 {
+		t.Fatalf("Expected to resume at offset 11, line 1, got %+v", resumed)
+	}
+
+	// The same inode with different content is a different file
+	if err = ioutil.WriteFile(path, []byte("replaced\n"), 0644); err != nil {
+		testBug(err)
+	}
+	info, _ = os.Stat(path)
+	if resumed := p.calculate_resume(path, info, resume); resumed != nil {
+		t.Fatalf("Expected not to resume a file whose content was replaced")
+	}
+
+	// Without fingerprints only the inode is compared
+	p = NewProspector(FileConfig{})
+	if resumed := p.calculate_resume(path, info, resume); resumed == nil {
+		t.Fatalf("Expected to resume by inode with fingerprints disabled")
+	}
+}
+
+func TestProspectorInodeReused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-fingerprint")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "new.log")
+	if err = ioutil.WriteFile(path, []byte("new content\n"), 0644); err != nil {
+		testBug(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		testBug(err)
+	}
+
+	for _, test := range []struct {
+		old     string
+		renamed bool
+	}{
+		// old.log was deleted and new.log took its inode
+		{"old content\n", false},
+		// old.log was renamed to new.log
+		{"new content\n", true},
+	} {
+		p := NewProspector(FileConfig{FingerprintBytes: 1024, deadtime: time.Hour})
+		old := ProspectorInfo{fileinfo: info, harvester: make(chan *FileState, 1), fingerprint: NewFingerprint([]byte(test.old))}
+		p.prospectorinfo = map[string]ProspectorInfo{filepath.Join(dir, "old.log"): old}
+
+		output := make(chan *FileEvent, 10)
+		p.scan(filepath.Join(dir, "*.log"), output, nil)
+		close(p.stop)
+		p.harvesters.Wait()
+
+		if renamed := p.prospectorinfo[path].harvester == old.harvester; renamed != test.renamed {
+			t.Errorf("Expected new.log renamed from old.log with content %q to be %v, got %v", test.old, test.renamed, renamed)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+)
+
+// A path component of "**" in a glob matches any number of directories,
+// including none.
+const recursive_glob = "**"
+
+// Glob is like filepath.Glob, but also supports "**" path components.
+// Directories are not returned for recursive globs, and "**" does not follow
+// symlinks to directories.
+func Glob(pattern string) ([]string, error) {
+  // The paths walked are clean, so the pattern must be too
+  pattern = filepath.Clean(pattern)
+  components := strings.Split(pattern, string(filepath.Separator))
+
+  recursive := false
+  for _, component := range components {
+    if component == recursive_glob {
+      recursive = true
+      break
+    }
+  }
+  if !recursive {
+    return filepath.Glob(pattern)
+  }
+
+  // Validate the other components up front, like filepath.Glob does
+  for _, component := range components {
+    if component == recursive_glob {
+      continue
+    }
+    if _, err := filepath.Match(component, ""); err != nil {
+      return nil, err
+    }
+  }
+
+  // Walk from the deepest directory that has no wildcards in its path
+  base := 0
+  for base < len(components)-1 && !has_meta(components[base]) {
+    base++
+  }
+  root := strings.Join(components[:base], string(filepath.Separator))
+  if root == "" {
+    if filepath.IsAbs(pattern) {
+      root = string(filepath.Separator)
+    } else {
+      root = "."
+    }
+  }
+
+  var matches []string
+  filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+    if err != nil {
+      // Skip anything we can't read rather than giving up
+      if info != nil && info.IsDir() {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    if info.IsDir() {
+      return nil
+    }
+    if match_components(components, strings.Split(path, string(filepath.Separator))) {
+      matches = append(matches, path)
+    }
+    return nil
+  })
+  return matches, nil
+}
+
+func has_meta(component string) bool {
+  return component == recursive_glob || strings.ContainsAny(component, "*?[\\")
+}
+
+func match_components(pattern []string, name []string) bool {
+  for len(pattern) > 0 {
+    if pattern[0] == recursive_glob {
+      for i := 0; i <= len(name); i++ {
+        if match_components(pattern[1:], name[i:]) {
+          return true
+        }
+      }
+      return false
+    }
+
+    if len(name) == 0 {
+      return false
+    }
+    if matched, _ := filepath.Match(pattern[0], name[0]); !matched {
+      return false
+    }
+    pattern, name = pattern[1:], name[1:]
+  }
+  return len(name) == 0
+}
+
+// Prefix for exclude files entries that are regular expressions rather than
+// globs.
+const exclude_regexp_prefix = "regexp:"
+
+// An ExcludePattern matches files that should not be harvested. Globs are
+// matched against both the full path and the file name, so "*.gz" excludes
+// compressed files in any directory. Regular expressions are matched
+// against the full path.
+type ExcludePattern struct {
+  glob   string
+  regexp *regexp.Regexp
+}
+
+func compile_exclude_patterns(patterns []string) (compiled []*ExcludePattern, err error) {
+  for _, pattern := range patterns {
+    if strings.HasPrefix(pattern, exclude_regexp_prefix) {
+      re, err := regexp.Compile(strings.TrimPrefix(pattern, exclude_regexp_prefix))
+      if err != nil {
+        return nil, fmt.Errorf("failed to compile pattern '%s': %s", pattern, err)
+      }
+      compiled = append(compiled, &ExcludePattern{regexp: re})
+      continue
+    }
+
+    if _, err := filepath.Match(pattern, ""); err != nil {
+      return nil, fmt.Errorf("invalid glob '%s': %s", pattern, err)
+    }
+    compiled = append(compiled, &ExcludePattern{glob: pattern})
+  }
+  return
+}
+
+func (e *ExcludePattern) Match(path string) bool {
+  if e.regexp != nil {
+    return e.regexp.MatchString(path)
+  }
+  if matched, _ := filepath.Match(e.glob, path); matched {
+    return true
+  }
+  matched, _ := filepath.Match(e.glob, filepath.Base(path))
+  return matched
+}
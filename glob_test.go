@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestGlobRecursive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-glob")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"app.log",
+		"tenant-a/app.log",
+		"tenant-a/app.log.1",
+		"tenant-b/web/app.log",
+		"tenant-b/web/app.log.gz",
+	} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			testBug(err)
+		}
+	}
+
+	matches, err := Glob(filepath.Join(dir, "**", "*.log"))
+	if err != nil {
+		t.Fatalf("Glob failed: %s", err)
+	}
+	sort.Strings(matches)
+	expected := []string{
+		filepath.Join(dir, "app.log"),
+		filepath.Join(dir, "tenant-a/app.log"),
+		filepath.Join(dir, "tenant-b/web/app.log"),
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Fatalf("Expected %v, got %v", expected, matches)
+	}
+
+	matches, err = Glob(filepath.Join(dir, "tenant-*", "**", "app.log*"))
+	if err != nil {
+		t.Fatalf("Glob failed: %s", err)
+	}
+	if len(matches) != 4 {
+		t.Fatalf("Expected 4 matches under tenant directories, got %v", matches)
+	}
+
+	if _, err = Glob(filepath.Join(dir, "**", "[")); err == nil {
+		t.Fatalf("Expected an error for a bad pattern")
+	}
+}
+
+func TestGlobRecursiveRelative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-glob")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "logs", "a"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "logs", "a", "x.log"), nil, 0644); err != nil {
+		testBug(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		testBug(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		testBug(err)
+	}
+
+	expected := []string{filepath.Join("logs", "a", "x.log")}
+	for _, pattern := range []string{"logs/**/*.log", "./logs/**/*.log", "logs//**/./*.log"} {
+		matches, err := Glob(filepath.FromSlash(pattern))
+		if err != nil {
+			t.Fatalf("Glob failed: %s", err)
+		}
+		if !reflect.DeepEqual(matches, expected) {
+			t.Errorf("Expected %s to match %v, got %v", pattern, expected, matches)
+		}
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	var err error
+	config := FileConfig{ExcludeFiles: []string{"*.gz", "/var/log/old/*", `regexp:\.log\.\d+$`}}
+	config.exclude_files, err = compile_exclude_patterns(config.ExcludeFiles)
+	if err != nil {
+		t.Fatalf("Failed to compile patterns: %s", err)
+	}
+
+	for path, excluded := range map[string]bool{
+		"/var/log/app.log":         false,
+		"/var/log/app.log.1":       true,
+		"/var/log/tenant/app.gz":   true,
+		"/var/log/old/app.log":     true,
+		"/var/log/old/sub/app.log": false,
+	} {
+		if config.IsExcluded(path) != excluded {
+			t.Errorf("Expected IsExcluded(%s) to be %v", path, excluded)
+		}
+	}
+
+	if _, err = compile_exclude_patterns([]string{"regexp:("}); err == nil {
+		t.Errorf("Expected an error for a bad regexp")
+	}
+}
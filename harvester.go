@@ -4,91 +4,357 @@ import (
   "bufio"
   "bytes"
   "io"
+  "io/ioutil"
   "log"
   "os" // for File and friends
+  "strings"
   "time"
+
+  "golang.org/x/text/encoding"
 )
 
+// How far the harvester gets past lines it dropped, in bytes or in time,
+// before telling the registrar about them rather than waiting for the file to
+// go quiet, so a file where every line is dropped still has its offset saved.
+const skipped_position_bytes = 1 << 20
+const skipped_position_interval = 10 * time.Second
+
 type Harvester struct {
   Path string /* the file path to harvest */
   FileConfig FileConfig
   Offset int64
-  FinishChan chan int64
+  Line uint64 /* the number of the line ending at Offset, 0 if unknown */
+  FinishChan chan *FileState /* the final offset and line number are sent on this when harvesting stops */
+  StopChan chan bool /* closed to ask the harvester to stop */
 
   file *os.File /* the file being watched */
+  skipped_to int64 /* end of lines dropped since the last shipped event, or 0 */
+  skipped_line uint64 /* number of the last line dropped */
+  skipped_from int64 /* start of the first of those lines */
+  skipped_since time.Time /* when the first of those lines was dropped */
+  line_overflow int /* bytes of the current line past max line bytes, skipped */
+  line_tail [4]byte /* the last bytes read of the current line */
+  fingerprint *Fingerprint /* of the start of the file, if fingerprint bytes is set */
+  changes chan struct{} /* notified when the file is written to */
+  compression string /* the format the file is compressed in, if it is to be decompressed */
+  complete bool /* a compressed file has been read to its end */
+  decoder *encoding.Decoder
 }
 
 func (h *Harvester) Harvest(output chan *FileEvent) {
-  h.open()
+  h.FileConfig.poll_interval = default_interval(h.FileConfig.poll_interval, default_FileConfig_PollInterval)
+
+  // On completion, push offset so we can continue where we left off if we relaunch on the same file
+  defer func() {
+    if h.FinishChan != nil {
+      h.FinishChan <- &FileState{Offset: h.Offset, Line: h.Line, Fingerprint: h.fingerprint, Complete: h.complete}
+    }
+  }()
+
+  if h.open() == nil {
+    // Stopped before the file could be opened
+    return
+  }
   info, _ := h.file.Stat() // TODO(sissel): Check error
   defer h.file.Close()
-  //info, _ := file.Stat()
 
-  // On completion, push offset so we can continue where we left off if we relaunch on the same file
-  defer func() { h.FinishChan <- h.Offset }()
+  // Let the registrar know about any lines dropped since the last event on
+  // the way out too. Only if there is room for it, so a spooler that is
+  // stuck can't keep the harvester from stopping.
+  defer func() {
+    if h.skipped_to > 0 && h.skipped_to <= h.Offset {
+      select {
+      case output <- h.skipped_position(&info):
+        h.skipped_to = 0
+      default:
+      }
+    }
+  }()
+
+  if h.Path != "-" {
+    // Wake up as soon as the file is written to, rather than on the next poll
+    h.changes = make(chan struct{}, 1)
+    if err := watcher.Watch(h.Path, h.changes); err != nil {
+      log.Printf("Failed to watch %s for changes, polling it instead: %s\n", h.Path, err)
+    }
+    defer watcher.Unwatch(h.changes)
+  }
 
-  var line uint64 = 0 // Ask registrar about the line number
+  metrics.HarvesterStarted()
+  defer metrics.HarvesterStopped()
+  //info, _ := file.Stat()
 
-  // get current offset in file
-  offset, _ := h.file.Seek(0, os.SEEK_CUR)
+  var source io.Reader = h.file
+  if h.FileConfig.Decompress && h.Path != "-" {
+    h.compression = detect_compression(h.file, h.Path)
+  }
 
-  if h.Offset > 0 {
-    log.Printf("Started harvester at position %d (current offset now %d): %s\n", h.Offset, offset, h.Path)
-  } else if *from_beginning {
-    log.Printf("Started harvester from beginning of file (current offset now %d): %s\n", offset, h.Path)
+  if h.compression != compression_none {
+    decompressed, err := h.open_decompressed()
+    if err != nil {
+      log.Printf("Failed to decompress %s from position %d, will retry when it changes: %s\n", h.Path, h.Offset, err)
+      return
+    }
+    source = decompressed
+    log.Printf("Started harvester on %s compressed file at position %d: %s\n", h.compression, h.Offset, h.Path)
   } else {
-    log.Printf("Started harvester at end of file (current offset now %d): %s\n", offset, h.Path)
-  }
+    // get current offset in file
+    offset, _ := h.file.Seek(0, os.SEEK_CUR)
+
+    if h.Offset > 0 {
+      log.Printf("Started harvester at position %d (current offset now %d): %s\n", h.Offset, offset, h.Path)
+    } else if *from_beginning {
+      log.Printf("Started harvester from beginning of file (current offset now %d): %s\n", offset, h.Path)
+    } else {
+      log.Printf("Started harvester at end of file (current offset now %d): %s\n", offset, h.Path)
+    }
 
-  h.Offset = offset
+    if offset != h.Offset {
+      // Started somewhere other than where the line number was saved for
+      h.Line = 0
+    }
+    h.Offset = offset
+  }
+  h.content_replaced()
 
   // TODO(sissel): Make the buffer size tunable at start-time
-  reader := bufio.NewReaderSize(h.file, 16<<10) // 16kb buffer by default
+  reader := bufio.NewReaderSize(source, 16<<10) // 16kb buffer by default
   buffer := new(bytes.Buffer)
 
   var read_timeout = 10 * time.Second
+
+  var multiline *Multiline
+  if h.FileConfig.Multiline != nil {
+    multiline = NewMultiline(h.FileConfig.Multiline, h.FileConfig.MaxLineBytes)
+    // Wake up often enough to flush a pending event on time
+    if h.FileConfig.Multiline.timeout < read_timeout {
+      read_timeout = h.FileConfig.Multiline.timeout
+    }
+  }
+
   last_read_time := time.Now()
   for {
-    text, bytesread, err := h.readline(reader, buffer, read_timeout)
+    text, bytesread, truncated, err := h.readline(reader, buffer, read_timeout)
 
     if err != nil {
       if err == io.EOF {
+        if h.stopping() {
+          // Resume from the start of anything not yet shipped
+          if multiline != nil {
+            if event := multiline.Flush(); event != nil {
+              h.rewind(event)
+            }
+          }
+          return
+        }
+
         // timed out waiting for data, got eof.
-        // Check to see if the file was truncated
+        // Ship any multiline event that has waited long enough
+        if multiline != nil && multiline.Expired() {
+          if !h.emit(output, multiline.Flush()) {
+            return
+          }
+        }
+
+        // Let the registrar know about any lines we dropped, so they are not
+        // read again after a restart
+        if h.skipped_to > 0 && !h.send_skipped(output, &info) {
+          return
+        }
+
+        if h.compression != compression_none {
+          // Compressed files are written once, so this is the end of it
+          if multiline != nil {
+            if event := multiline.Flush(); event != nil && !h.emit(output, event) {
+              return
+            }
+          }
+          end := &FileEvent{Source: &h.Path, Offset: h.Offset, Line: h.Line, fileinfo: &info, fingerprint: h.fingerprint, complete: true}
+          if h.send(output, end) {
+            log.Printf("Finished harvesting compressed file: %s\n", h.Path)
+            h.complete = true
+          }
+          return
+        }
+
+        // Check to see if the file was truncated, or truncated and written
+        // again since we last looked
         info, _ := h.file.Stat()
-        if info.Size() < h.Offset {
-          log.Printf("File truncated, seeking to beginning: %s\n", h.Path)
+        replaced := h.content_replaced()
+        if info.Size() < h.Offset || replaced {
+          if info.Size() < h.Offset {
+            log.Printf("File truncated, seeking to beginning: %s\n", h.Path)
+          } else {
+            log.Printf("File content replaced, seeking to beginning: %s\n", h.Path)
+          }
+          if multiline != nil {
+            if event := multiline.Flush(); event != nil && !h.emit(output, event) {
+              return
+            }
+          }
           h.file.Seek(0, os.SEEK_SET)
           h.Offset = 0
+          h.Line = 0
         } else if age := time.Since(last_read_time); age > h.FileConfig.deadtime {
           // if last_read_time was more than dead time, this file is probably
           // dead. Stop watching it.
           log.Printf("Stopping harvest of %s; last change was %v ago\n", h.Path, age)
+          if multiline != nil {
+            if event := multiline.Flush(); event != nil {
+              h.emit(output, event)
+            }
+          }
           return
         }
         continue
+      } else if h.compression != compression_none && err == io.ErrUnexpectedEOF {
+        // Resumed from the last full line once the rest has been written
+        log.Printf("Compressed file ends early, will resume when it changes: %s\n", h.Path)
+        return
       } else {
         log.Printf("Unexpected state reading from %s; error: %s\n", h.Path, err)
         return
       }
     }
     last_read_time = time.Now()
+    metrics.LineRead(h.Path, bytesread)
 
-    line++
+    if h.Offset == 0 && h.FileConfig.text_encoding != nil {
+      // Drop a byte order mark at the start of the file
+      *text = strings.TrimPrefix(*text, "\ufeff")
+    }
+
+    // Line numbers are only known when counting from the start of the file,
+    // or from a saved line number
+    if h.Line > 0 || h.Offset == 0 {
+      h.Line++
+    }
     event := &FileEvent{
       Source: &h.Path,
       Offset: h.Offset,
-      Line: line,
+      Line: h.Line,
       Text: text,
+      RawLength: int64(bytesread),
+      Truncated: truncated,
       Fields: &h.FileConfig.Fields,
       fileinfo: &info,
+      fingerprint: h.fingerprint,
     }
-    offset += int64(bytesread)
+    h.Offset += int64(bytesread)
 
-    output <- event // ship the new event downstream
+    if multiline != nil {
+      for _, event := range multiline.Push(event) {
+        if !h.emit(output, event) {
+          return
+        }
+      }
+      continue
+    }
+
+    if !h.emit(output, event) { // ship the new event downstream
+      return
+    }
   } /* forever */
 }
 
+// emit ships an event downstream if it passes the line filters.
+func (h *Harvester) emit(output chan *FileEvent, event *FileEvent) bool {
+  if !h.FileConfig.ShouldShip(*event.Text) {
+    if h.skipped_to == 0 {
+      h.skipped_from, h.skipped_since = event.Offset, time.Now()
+    }
+    h.skipped_to = event.Offset + event.RawLength
+    h.skipped_line = event.last_line()
+    if h.skipped_to-h.skipped_from >= skipped_position_bytes || time.Since(h.skipped_since) >= skipped_position_interval {
+      return h.send_skipped(output, event.fileinfo)
+    }
+    return true
+  }
+  h.skipped_to = 0
+  if h.FileConfig.Codec != nil {
+    h.FileConfig.Codec.Decode(event)
+  }
+  return h.send(output, event)
+}
+
+// send_skipped ships the position at the end of the lines dropped since the
+// last event.
+func (h *Harvester) send_skipped(output chan *FileEvent, fileinfo *os.FileInfo) bool {
+  if !h.send(output, h.skipped_position(fileinfo)) {
+    return false
+  }
+  h.skipped_to = 0
+  return true
+}
+
+func (h *Harvester) skipped_position(fileinfo *os.FileInfo) *FileEvent {
+  return &FileEvent{Source: &h.Path, Offset: h.skipped_to, Line: h.skipped_line, fileinfo: fileinfo, fingerprint: h.fingerprint}
+}
+
+// send ships an event downstream. If the harvester is asked to stop first,
+// the event is dropped, the offset is rewound to its start so it is read
+// again when harvesting resumes, and false is returned.
+func (h *Harvester) send(output chan *FileEvent, event *FileEvent) bool {
+  select {
+  case output <- event:
+    return true
+  case <-h.StopChan:
+    h.rewind(event)
+    return false
+  }
+}
+
+// rewind moves the harvester back to the start of an event that wasn't
+// shipped.
+func (h *Harvester) rewind(event *FileEvent) {
+  h.Offset = event.Offset
+  switch {
+  case event.Text == nil:
+    // A position, which already ends at its offset
+    h.Line = event.Line
+  case event.Line > 0:
+    h.Line = event.Line - 1
+  default:
+    h.Line = 0
+  }
+}
+
+// open_decompressed starts decompressing the file from its beginning, and
+// skips over the offset already read, as compressed files can't be seeked in.
+func (h *Harvester) open_decompressed() (io.Reader, error) {
+  if _, err := h.file.Seek(0, os.SEEK_SET); err != nil {
+    return nil, err
+  }
+  reader, err := decompress(h.file, h.compression)
+  if err != nil {
+    return nil, err
+  }
+  if _, err = io.CopyN(ioutil.Discard, reader, h.Offset); err != nil {
+    return nil, err
+  }
+  return reader, nil
+}
+
+// content_replaced reports whether the start of the file no longer matches
+// its fingerprint, and takes the fingerprint again.
+func (h *Harvester) content_replaced() bool {
+  if h.Path == "-" {
+    return false
+  }
+  matches, fingerprint := match_fingerprint(h.file, h.fingerprint, int64(h.FileConfig.FingerprintBytes))
+  h.fingerprint = fingerprint
+  return !matches
+}
+
+func (h *Harvester) stopping() bool {
+  select {
+  case <-h.StopChan:
+    return true
+  default:
+    return false
+  }
+}
+
 func (h *Harvester) open() *os.File {
   // Special handling that "-" means to read from standard input
   if h.Path == "-" {
@@ -96,15 +362,24 @@ func (h *Harvester) open() *os.File {
     return h.file
   }
 
+  backoff := NewBackoff(h.Path, h.FileConfig.BackoffConfig)
   for {
     var err error
     h.file, err = os.Open(h.Path)
 
     if err != nil {
       // retry on failure.
-      log.Printf("Failed opening %s: %s\n", h.Path, err)
-      time.Sleep(5 * time.Second)
+      delay := backoff.Failed()
+      log.Printf("Failed opening %s, will try again in %v (failure %d in a row): %s\n",
+        h.Path, delay, backoff.Failures(), err)
+      select {
+      case <-h.StopChan:
+        backoff.Reset()
+        return nil
+      case <-time.After(delay):
+      }
     } else {
+      backoff.Reset()
       break
     }
   }
@@ -121,56 +396,130 @@ func (h *Harvester) open() *os.File {
   return h.file
 }
 
-func (h *Harvester) readline(reader *bufio.Reader, buffer *bytes.Buffer, eof_timeout time.Duration) (*string, int, error) {
-  var is_partial bool = true
-  var newline_length int = 1
+// readline returns the next line, decoded into UTF-8 without its EOL chars,
+// and the number of bytes it took up in the file. Lines longer than max line
+// bytes are cut short and flagged as truncated, and the rest of the line is
+// skipped.
+func (h *Harvester) readline(reader *bufio.Reader, buffer *bytes.Buffer, eof_timeout time.Duration) (*string, int, bool, error) {
+  encoding := h.FileConfig.text_encoding
+  max := h.FileConfig.MaxLineBytes
+  // Never cut a line in the middle of a code unit
+  max -= max % encoding.unit_size()
   start_time := time.Now()
 
   for {
-    segment, err := reader.ReadBytes('\n')
-
-    if segment != nil && len(segment) > 0 {
-      if segment[len(segment)-1] == '\n' {
-        // Found a complete line
-        is_partial = false
+    var segment []byte
+    var err error
+    if encoding.needs_next_byte(h.line_tail, buffer.Len()+h.line_overflow) {
+      var b byte
+      if b, err = reader.ReadByte(); err == nil {
+        segment = []byte{b}
+      }
+    } else {
+      segment, err = reader.ReadSlice('\n')
+      if err == bufio.ErrBufferFull {
+        // The line is longer than the reader's buffer, keep reading it
+        err = nil
+      }
+    }
 
-        // Check if also a CR present
-        if len(segment) > 1 && segment[len(segment)-2] == '\r' {
-          newline_length++
+    if len(segment) > 0 {
+      // Only keep as much of the line as we might ship, plus room for the
+      // EOL chars, so a line without an end can't use up all our memory
+      keep := len(segment)
+      if max > 0 {
+        if room := max + 4 - buffer.Len(); room < keep {
+          keep = room
+        }
+        if keep < 0 {
+          keep = 0
         }
       }
+      buffer.Write(segment[:keep])
+      h.line_overflow += len(segment) - keep
 
-      // TODO(sissel): if buffer exceeds a certain length, maybe report an error condition? chop it?
-      buffer.Write(segment)
+      // Remember the last few bytes, even if they were skipped, to find the
+      // end of the line
+      tail := segment
+      if len(tail) > len(h.line_tail) {
+        tail = tail[len(tail)-len(h.line_tail):]
+      }
+      for _, b := range tail {
+        copy(h.line_tail[:], h.line_tail[1:])
+        h.line_tail[len(h.line_tail)-1] = b
+      }
     }
 
+    line_length := buffer.Len() + h.line_overflow
+    newline_length := encoding.line_end(h.line_tail, line_length)
+    is_partial := newline_length == 0
+
     if err != nil {
-      if err == io.EOF && is_partial {
-        time.Sleep(1 * time.Second) // TODO(sissel): Implement backoff
+      if err == io.EOF && is_partial && h.compression != compression_none {
+        // The end of a compressed file, nothing more will be written to it
+        return nil, 0, false, err
+      } else if err == io.EOF && is_partial {
+        select {
+        case <-h.StopChan:
+          return nil, 0, false, err
+        case <-h.changes:
+        case <-time.After(h.FileConfig.poll_interval):
+        }
 
         // Give up waiting for data after a certain amount of time.
         // If we time out, return the error (eof)
         if time.Since(start_time) > eof_timeout {
-          return nil, 0, err
+          return nil, 0, false, err
         }
         continue
-      } else {
-        log.Println(err)
-        return nil, 0, err // TODO(sissel): don't do this?
+      } else if err != io.EOF {
+        if err != io.ErrUnexpectedEOF || h.compression == compression_none {
+          log.Println(err)
+        }
+        return nil, 0, false, err // TODO(sissel): don't do this?
       }
     }
 
     // If we got a full line, return the whole line without the EOL chars (CRLF or LF)
     if !is_partial {
-      // Get the str length with the EOL chars (LF or CRLF)
-      bufferSize := buffer.Len()
+      text_length := line_length - newline_length
+      truncated := false
+      if max > 0 && text_length > max {
+        text_length = max
+        truncated = true
+      }
+
       str := new(string)
-      *str = buffer.String()[:bufferSize - newline_length]
+      *str = h.decode(buffer.Bytes()[:text_length], truncated)
       // Reset the buffer for the next line
       buffer.Reset()
-      return str, bufferSize, nil
+      h.line_overflow = 0
+      h.line_tail = [4]byte{}
+      return str, line_length, truncated, nil
     }
   } /* forever read chunks */
 
-  return nil, 0, nil
+  return nil, 0, false, nil
+}
+
+// decode converts a line from the file's encoding into UTF-8.
+func (h *Harvester) decode(raw []byte, truncated bool) string {
+  encoding := h.FileConfig.text_encoding
+  if encoding == nil || encoding.encoding == nil {
+    if truncated {
+      raw = trim_partial_rune(raw)
+    }
+    return string(raw)
+  }
+
+  if h.decoder == nil {
+    // Decoders keep state, so each harvester needs its own
+    h.decoder = encoding.encoding.NewDecoder()
+  }
+  text, err := h.decoder.Bytes(raw)
+  if err != nil {
+    log.Printf("Failed to decode a line of %s from %s: %s\n", h.Path, encoding.name, err)
+    return string(raw)
+  }
+  return string(text)
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadlineMaxLineBytes(t *testing.T) {
+	long := strings.Repeat("x", 40000)
+	input := "short\n" + long + "\r\n" + "0123456789\r\n" + "end\n"
+
+	h := &Harvester{FileConfig: FileConfig{MaxLineBytes: 10}}
+	reader := bufio.NewReaderSize(strings.NewReader(input), 16)
+	buffer := new(bytes.Buffer)
+
+	expected := []struct {
+		text      string
+		length    int
+		truncated bool
+	}{
+		{"short", 6, false},
+		{"xxxxxxxxxx", len(long) + 2, true},
+		{"0123456789", 12, false},
+		{"end", 4, false},
+	}
+
+	var offset int
+	for _, e := range expected {
+		text, length, truncated, err := h.readline(reader, buffer, time.Millisecond)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if *text != e.text || length != e.length || truncated != e.truncated {
+			t.Fatalf("Expected %q (%d bytes, truncated %v), got %q (%d bytes, truncated %v)",
+				e.text, e.length, e.truncated, *text, length, truncated)
+		}
+		offset += length
+	}
+	if offset != len(input) {
+		t.Fatalf("Expected lines to add up to %d bytes, got %d", len(input), offset)
+	}
+	if buffer.Cap() > 1024 {
+		t.Fatalf("Buffer grew to %d bytes for a 10 byte limit", buffer.Cap())
+	}
+}
+
+func TestReadlineEncodings(t *testing.T) {
+	tests := []struct {
+		encoding string
+		input    []byte
+		lines    []string
+	}{
+		{
+			// "Ċ" is U+010A, whose low byte is an LF
+			"utf-16le",
+			[]byte("\xff\xfea\x00\n\x01\r\x00\n\x00b\x00\n\x00"),
+			[]string{"\ufeffaĊ", "b"},
+		},
+		{
+			// "ਊ" is U+0A0A, both of its bytes are LFs
+			"utf-16be",
+			[]byte("\x00a\n\n\x00\n\x00b\x00\r\x00\n"),
+			[]string{"aਊ", "b"},
+		},
+		{
+			"latin1",
+			[]byte("caf\xe9\r\nna\xefve\n"),
+			[]string{"café", "naïve"},
+		},
+		{
+			"shift_jis",
+			[]byte("\x93\xfa\x96\x7b\n\x83\x65\x83\x58\x83\x67\n"),
+			[]string{"日本", "テスト"},
+		},
+	}
+
+	for _, test := range tests {
+		encoding, err := NewTextEncoding(test.encoding)
+		if err != nil {
+			t.Fatalf("Failed to find encoding %s: %s", test.encoding, err)
+		}
+		h := &Harvester{FileConfig: FileConfig{text_encoding: encoding}}
+		// A small buffer, so lines are split across reads
+		reader := bufio.NewReaderSize(strings.NewReader(string(test.input)), 16)
+		buffer := new(bytes.Buffer)
+
+		var offset int
+		for _, expected := range test.lines {
+			text, length, _, err := h.readline(reader, buffer, time.Millisecond)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", test.encoding, err)
+			}
+			if *text != expected {
+				t.Errorf("%s: expected %q, got %q", test.encoding, expected, *text)
+			}
+			offset += length
+		}
+		if offset != len(test.input) {
+			t.Errorf("%s: expected lines to add up to %d bytes, got %d", test.encoding, len(test.input), offset)
+		}
+	}
+
+	if _, err := NewTextEncoding("klingon"); err == nil {
+		t.Errorf("Expected an error for an unknown encoding")
+	}
+}
+
+func TestHarvestLineNumbers(t *testing.T) {
+	file, err := ioutil.TempFile("", "logstash-forwarder-harvest")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("one\ntwo\nthree\n")
+	file.Close()
+
+	for _, test := range []struct {
+		line     uint64
+		expected []uint64
+	}{
+		// Resumed from a saved line number
+		{1, []uint64{2, 3}},
+		// Resumed without one, so line numbers are unknown
+		{0, []uint64{0, 0}},
+	} {
+		output := make(chan *FileEvent, 10)
+		h := &Harvester{
+			Path:       file.Name(),
+			FileConfig: FileConfig{deadtime: time.Hour},
+			Offset:     4,
+			Line:       test.line,
+			FinishChan: make(chan *FileState, 1),
+			StopChan:   make(chan bool),
+		}
+		go h.Harvest(output)
+
+		for _, expected := range test.expected {
+			select {
+			case event := <-output:
+				if event.Line != expected {
+					t.Errorf("Expected %q to be line %d, got %d", *event.Text, expected, event.Line)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for an event")
+			}
+		}
+
+		close(h.StopChan)
+		state := <-h.FinishChan
+		if state.Offset != 14 || state.Line != test.expected[len(test.expected)-1] {
+			t.Errorf("Expected to finish at offset 14, line %d, got %d, %d", test.expected[len(test.expected)-1], state.Offset, state.Line)
+		}
+	}
+}
+
+func TestHarvestDroppedLinesPosition(t *testing.T) {
+	file, err := ioutil.TempFile("", "logstash-forwarder-harvest")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("head\n" + strings.Repeat("drop this line\n", skipped_position_bytes/10))
+	info, _ := file.Stat()
+	file.Close()
+
+	exclude, err := compile_patterns([]string{"^drop"})
+	if err != nil {
+		testBug(err)
+	}
+	output := make(chan *FileEvent, 10)
+	h := &Harvester{
+		Path:       file.Name(),
+		FileConfig: FileConfig{deadtime: time.Hour, exclude_lines: exclude},
+		Offset:     5,
+		FinishChan: make(chan *FileState, 1),
+		StopChan:   make(chan bool),
+	}
+	go h.Harvest(output)
+
+	position := func() *FileEvent {
+		select {
+		case event := <-output:
+			if event.Text != nil {
+				t.Fatalf("Expected only positions, got %q", *event.Text)
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a position")
+		}
+		return nil
+	}
+
+	// Sent once enough has been dropped, without waiting for the file to go
+	// quiet
+	if event := position(); event.Offset < skipped_position_bytes || event.Offset >= info.Size() {
+		t.Errorf("Expected a position past %d bytes of dropped lines, got %d", skipped_position_bytes, event.Offset)
+	}
+
+	// And the rest when the harvester stops
+	time.Sleep(100 * time.Millisecond)
+	close(h.StopChan)
+	if event := position(); event.Offset != info.Size() {
+		t.Errorf("Expected a position at the end of the file, %d, got %d", info.Size(), event.Offset)
+	}
+	<-h.FinishChan
+}
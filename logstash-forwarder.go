@@ -1,7 +1,6 @@
 package main
 
 import (
-  "encoding/json"
   "flag"
   "log"
   "os"
@@ -9,14 +8,31 @@ import (
   "time"
 )
 
+// Exit status when events were still waiting to be acknowledged at shutdown
+const exit_shutdown_timeout = 2
+
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 var spool_size = flag.Uint64("spool-size", 1024, "Maximum number of events to spool before a flush is forced.")
 var idle_timeout = flag.Duration("idle-flush-time", 5*time.Second, "Maximum time to wait for a full spool before flushing anyway")
 var config_file = flag.String("config", "", "The config file to load")
 var use_syslog = flag.Bool("log-to-syslog", false, "Log to syslog instead of stdout")
 var from_beginning = flag.Bool("from-beginning", false, "Read new files from the beginning, instead of the end")
+var disk_spool = flag.String("disk-spool", "", "Directory to spool events to disk in before publishing them. Disabled if empty")
+var disk_spool_size = flag.Int64("disk-spool-size", 1<<30, "Maximum number of bytes to keep in the disk spool")
+var disk_spool_segment_size = flag.Int64("disk-spool-segment-size", 64<<20, "Size in bytes at which the disk spool starts a new segment file")
+var metrics_address = flag.String("metrics", "", "Address to serve metrics and status over HTTP on, such as localhost:9090. Disabled if empty")
+var registry_file = flag.String("registry-file", "", "The file to save the position in each file to, overriding the config file. Defaults to .logstash-forwarder in the working directory")
+var use_inotify = flag.Bool("inotify", true, "On Linux, watch files and directories for changes with inotify, rather than only polling them")
+var shutdown_timeout = flag.Duration("shutdown-timeout", 10*time.Second, "Maximum time to wait for spooled events to be acknowledged when shutting down")
+
+// Held for as long as we run, so nothing else writes to the registry
+var registry_lock *os.File
 
 func main() {
+  if len(os.Args) > 1 && os.Args[1] == "registry" {
+    os.Exit(RegistryCommand(os.Args[2:]))
+  }
+
   flag.Parse()
 
   if *cpuprofile != "" {
@@ -37,8 +53,6 @@ func main() {
     return
   }
 
-  event_chan := make(chan *FileEvent, 16)
-  publisher_chan := make(chan []*FileEvent, 1)
   registrar_chan := make(chan []*FileEvent, 1)
 
   if len(config.Files) == 0 {
@@ -47,9 +61,10 @@ func main() {
 
   // The basic model of execution:
   // - prospector: finds files in paths/globs to harvest, starts harvesters
-  // - harvester: reads a file, sends events to the spooler
+  // - harvester: reads a file, sends events to the spooler of its output
   // - spooler: buffers events until ready to flush to the publisher
   // - publisher: writes to the network, notifies registrar
+  // Each output has a spooler and publisher of its own.
   // - registrar: records positions of files read
   // Finally, prospector uses the registrar information, on restart, to
   // determine where in each file to resume a harvester.
@@ -59,30 +74,36 @@ func main() {
     configureSyslog()
   }
 
-  resume := &ProspectorResume{}
-  resume.persist = make(chan *FileState)
+  if *metrics_address != "" {
+    go ServeMetrics(*metrics_address)
+  }
 
-  // Load the previous log file locations now, for use in prospector
-  resume.files = make(map[string]*FileState)
-  history, err := os.Open(".logstash-forwarder")
-  if err == nil {
-    wd, err := os.Getwd()
-    if err != nil {
-      wd = ""
+  if *use_inotify {
+    if watcher, err = NewWatcher(); err != nil {
+      log.Printf("Failed to start watching files, polling them instead: %s\n", err)
     }
-    log.Printf("Loading registrar data from %s/.logstash-forwarder\n", wd)
+  }
 
-    decoder := json.NewDecoder(history)
-    decoder.Decode(&resume.files)
-    history.Close()
+  registry_lock, err = LockRegistry(config.RegistryFile)
+  if err != nil {
+    log.Fatalf("Failed to lock the registry: %s\n", err)
   }
 
+  resume := &ProspectorResume{}
+  resume.persist = make(chan *FileState)
+
+  // Load the previous log file locations now, for use in prospector
+  resume.files = LoadRegistry(config.RegistryFile)
+
   prospector_pending := 0
+  prospectors := make(map[string]*Prospector)
+  outputs := StartOutputs(&config, registrar_chan)
 
   // Prospect the globs/paths given on the command line and launch harvesters
   for _, fileconfig := range config.Files {
-    prospector := &Prospector{FileConfig: fileconfig}
-    go prospector.Prospect(resume, event_chan)
+    prospector := NewProspector(fileconfig)
+    prospectors[file_config_id(&fileconfig)] = prospector
+    go prospector.Prospect(resume, outputs[fileconfig.Output].Events)
     prospector_pending++
   }
 
@@ -105,11 +126,22 @@ func main() {
 
   log.Printf("All prospectors initialised with %d states to persist\n", len(persist))
 
-  // Harvesters dump events into the spooler.
-  go Spool(event_chan, publisher_chan, *spool_size, *idle_timeout)
-
-  go Publishv1(publisher_chan, registrar_chan, &config.Network)
-
   // registrar records last acknowledged positions in all files.
-  Registrar(persist, registrar_chan)
+  finished := make(chan bool)
+  go func() {
+    Registrar(persist, registrar_chan, config.RegistryFile, config.clean_after)
+    close(finished)
+  }()
+
+  // Apply configuration changes on SIGHUP, until SIGINT or SIGTERM stops the
+  // harvesters so we can shut down
+  deadline := HandleSignals(*config_file, config, prospectors, outputs, *shutdown_timeout)
+
+  select {
+  case <-finished:
+    log.Printf("Shutdown complete\n")
+  case <-deadline:
+    log.Printf("Shutdown timed out after %v, unacknowledged events will be sent again on restart\n", *shutdown_timeout)
+    os.Exit(exit_shutdown_timeout)
+  }
 } /* main */
@@ -0,0 +1,322 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Metrics collects counters and gauges from every stage of the pipeline so
+// they can be served over HTTP.
+type Metrics struct {
+  mutex sync.Mutex
+
+  lines_read map[string]uint64 /* per file */
+  bytes_read map[string]uint64 /* per file */
+  acked      map[string]acked_position /* per file */
+  backoff    map[string]time.Duration /* current delay before retrying, per server or file */
+  connected  map[output_server]int /* open connections per output and server */
+
+  events_spooled         uint64
+  batches_published      uint64
+  ack_latency_sum        time.Duration
+  ack_latency_count      uint64
+  reconnects             uint64
+  tls_handshake_failures uint64
+  registry_write_failures uint64
+  harvesters             int64
+}
+
+// A server as connected to by one output's publisher.
+type output_server struct {
+  output string
+  server string
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+  return &Metrics{
+    lines_read: make(map[string]uint64),
+    bytes_read: make(map[string]uint64),
+    acked:      make(map[string]acked_position),
+    backoff:    make(map[string]time.Duration),
+    connected:  make(map[output_server]int),
+  }
+}
+
+func (m *Metrics) LineRead(path string, bytes int) {
+  m.mutex.Lock()
+  m.lines_read[path]++
+  m.bytes_read[path] += uint64(bytes)
+  m.mutex.Unlock()
+}
+
+func (m *Metrics) HarvesterStarted() {
+  m.mutex.Lock()
+  m.harvesters++
+  m.mutex.Unlock()
+}
+
+func (m *Metrics) HarvesterStopped() {
+  m.mutex.Lock()
+  m.harvesters--
+  m.mutex.Unlock()
+}
+
+func (m *Metrics) EventsSpooled(count int) {
+  m.mutex.Lock()
+  m.events_spooled += uint64(count)
+  m.mutex.Unlock()
+}
+
+// BatchPublished records a payload that was fully acknowledged, latency
+// after it was sent.
+func (m *Metrics) BatchPublished(latency time.Duration) {
+  m.mutex.Lock()
+  m.batches_published++
+  m.ack_latency_sum += latency
+  m.ack_latency_count++
+  m.mutex.Unlock()
+}
+
+// Connected records a connection opened by an output to a server.
+func (m *Metrics) Connected(output string, server string) {
+  m.mutex.Lock()
+  m.connected[output_server{output_name(output), server}]++
+  m.mutex.Unlock()
+}
+
+// Disconnected records a connection opened by Connected being closed.
+func (m *Metrics) Disconnected(output string, server string) {
+  m.mutex.Lock()
+  key := output_server{output_name(output), server}
+  if m.connected[key] > 1 {
+    m.connected[key]--
+  } else {
+    delete(m.connected, key)
+  }
+  m.mutex.Unlock()
+}
+
+func (m *Metrics) Reconnecting() {
+  m.mutex.Lock()
+  m.reconnects++
+  m.mutex.Unlock()
+}
+
+func (m *Metrics) HandshakeFailed() {
+  m.mutex.Lock()
+  m.tls_handshake_failures++
+  m.mutex.Unlock()
+}
+
+// BackingOff records that retries of target, a server or a file, are held
+// back for delay after a failure.
+func (m *Metrics) BackingOff(target string, delay time.Duration) {
+  m.mutex.Lock()
+  m.backoff[target] = delay
+  m.mutex.Unlock()
+}
+
+// BackedOff records that target succeeded again.
+func (m *Metrics) BackedOff(target string) {
+  m.mutex.Lock()
+  delete(m.backoff, target)
+  m.mutex.Unlock()
+}
+
+func (m *Metrics) RegistryWriteFailed() {
+  m.mutex.Lock()
+  m.registry_write_failures++
+  m.mutex.Unlock()
+}
+
+// The position acknowledged in a file.
+type acked_position struct {
+  offset   int64
+  complete bool /* a compressed file read to its end */
+}
+
+func (m *Metrics) Acknowledged(path string, offset int64, complete bool) {
+  m.mutex.Lock()
+  m.acked[path] = acked_position{offset, complete}
+  m.mutex.Unlock()
+}
+
+// Forget drops everything kept about a file, once it is no longer read.
+func (m *Metrics) Forget(path string) {
+  m.mutex.Lock()
+  delete(m.lines_read, path)
+  delete(m.bytes_read, path)
+  delete(m.acked, path)
+  m.mutex.Unlock()
+}
+
+// lag returns, for each file with an acknowledged offset, how many bytes of
+// it have not been acknowledged yet. Offsets in compressed files are of their
+// decompressed content, so there is nothing to compare them with until they
+// are complete.
+func (m *Metrics) lag() map[string]uint64 {
+  m.mutex.Lock()
+  acked := make(map[string]acked_position, len(m.acked))
+  for path, position := range m.acked {
+    acked[path] = position
+  }
+  m.mutex.Unlock()
+
+  lag := make(map[string]uint64, len(acked))
+  for path, position := range acked {
+    offset := position.offset
+    info, err := os.Stat(path)
+    if err != nil {
+      continue
+    }
+    if position.complete {
+      lag[path] = 0
+    } else if is_compressed(path) {
+      continue
+    } else if info.Size() >= offset {
+      lag[path] = uint64(info.Size() - offset)
+    } else {
+      // Truncated since it was last acknowledged
+      lag[path] = uint64(info.Size())
+    }
+  }
+  return lag
+}
+
+// WritePrometheus writes every metric in the Prometheus text format.
+func (m *Metrics) WritePrometheus(output io.Writer) {
+  lag := m.lag()
+
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  write_metric(output, "lines_read_total", "counter", "Lines read per file.", "file", m.lines_read)
+  write_metric(output, "bytes_read_total", "counter", "Bytes read per file.", "file", m.bytes_read)
+  write_metric(output, "events_spooled_total", "counter", "Events passed from the spooler to the publisher.", "", m.events_spooled)
+  write_metric(output, "batches_published_total", "counter", "Batches of events acknowledged by the server.", "", m.batches_published)
+  fmt.Fprintf(output, "# HELP logstash_forwarder_ack_latency_seconds Time from sending a batch to it being fully acknowledged.\n")
+  fmt.Fprintf(output, "# TYPE logstash_forwarder_ack_latency_seconds summary\n")
+  fmt.Fprintf(output, "logstash_forwarder_ack_latency_seconds_sum %g\n", m.ack_latency_sum.Seconds())
+  fmt.Fprintf(output, "logstash_forwarder_ack_latency_seconds_count %d\n", m.ack_latency_count)
+  write_metric(output, "reconnects_total", "counter", "Reconnections to a server after an error.", "", m.reconnects)
+  write_metric(output, "tls_handshake_failures_total", "counter", "Failed TLS handshakes.", "", m.tls_handshake_failures)
+  write_metric(output, "registry_write_failures_total", "counter", "Failed attempts to save the registry.", "", m.registry_write_failures)
+  fmt.Fprintf(output, "# HELP logstash_forwarder_server_connected Servers currently connected to, per output.\n")
+  fmt.Fprintf(output, "# TYPE logstash_forwarder_server_connected gauge\n")
+  for _, connected := range m.connected_servers() {
+    fmt.Fprintf(output, "logstash_forwarder_server_connected{output=\"%s\",server=\"%s\"} 1\n",
+      escape_label(connected.output), escape_label(connected.server))
+  }
+  backoff := make(map[string]float64, len(m.backoff))
+  for target, delay := range m.backoff {
+    backoff[target] = delay.Seconds()
+  }
+  write_metric(output, "backoff_seconds", "gauge", "The last delay before retrying a server or file that failed.", "target", backoff)
+  write_metric(output, "harvesters_open", "gauge", "Harvesters currently running.", "", m.harvesters)
+  write_metric(output, "file_lag_bytes", "gauge", "File size minus the acknowledged offset.", "file", lag)
+}
+
+func write_metric(output io.Writer, name string, kind string, help string, label string, value interface{}) {
+  name = "logstash_forwarder_" + name
+  fmt.Fprintf(output, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+
+  switch values := value.(type) {
+  case map[string]uint64:
+    for _, key := range sorted_keys(values) {
+      fmt.Fprintf(output, "%s{%s=\"%s\"} %d\n", name, label, escape_label(key), values[key])
+    }
+  case map[string]float64:
+    for _, key := range sorted_keys(values) {
+      fmt.Fprintf(output, "%s{%s=\"%s\"} %g\n", name, label, escape_label(key), values[key])
+    }
+  default:
+    fmt.Fprintf(output, "%s %d\n", name, value)
+  }
+}
+
+// connected_servers returns the servers connected to, sorted by output and
+// then server. It must be called with the mutex held.
+func (m *Metrics) connected_servers() []output_server {
+  servers := make([]output_server, 0, len(m.connected))
+  for connected := range m.connected {
+    servers = append(servers, connected)
+  }
+  sort.Slice(servers, func(i, j int) bool {
+    if servers[i].output != servers[j].output {
+      return servers[i].output < servers[j].output
+    }
+    return servers[i].server < servers[j].server
+  })
+  return servers
+}
+
+func sorted_keys[V any](values map[string]V) []string {
+  keys := make([]string, 0, len(values))
+  for key := range values {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+var label_escaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escape_label(value string) string {
+  return label_escaper.Replace(value)
+}
+
+// Status is a summary of the forwarder's state, served as JSON.
+type Status struct {
+  Servers    map[string][]string `json:"servers"` /* connected servers per output */
+  Harvesters int64               `json:"harvesters"`
+  Lag        map[string]uint64   `json:"lag"`
+  Backoff    map[string]string   `json:"backoff,omitempty"`
+}
+
+func (m *Metrics) Status() *Status {
+  lag := m.lag()
+
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+  status := &Status{Servers: make(map[string][]string), Harvesters: m.harvesters, Lag: lag}
+  for _, connected := range m.connected_servers() {
+    status.Servers[connected.output] = append(status.Servers[connected.output], connected.server)
+  }
+  if len(m.backoff) > 0 {
+    status.Backoff = make(map[string]string, len(m.backoff))
+    for target, delay := range m.backoff {
+      status.Backoff[target] = delay.String()
+    }
+  }
+  return status
+}
+
+// ServeMetrics serves /metrics in the Prometheus text format and /status as
+// JSON on the given address.
+func ServeMetrics(address string) {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    metrics.WritePrometheus(w)
+  })
+  mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(metrics.Status())
+  })
+
+  log.Printf("Serving metrics on http://%s/metrics\n", address)
+  err := http.ListenAndServe(address, mux)
+  if err != nil {
+    log.Fatalf("Failed to serve metrics on %s: %s\n", address, err)
+  }
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsPrometheus(t *testing.T) {
+	file, err := ioutil.TempFile("", "logstash-forwarder-metrics")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("0123456789")
+	file.Close()
+
+	m := NewMetrics()
+	m.LineRead(`C:\logs\"app".log`, 10)
+	m.LineRead(`C:\logs\"app".log`, 5)
+	m.HarvesterStarted()
+	m.BatchPublished(500 * time.Millisecond)
+	m.Connected("", "logstash:5043")
+	m.Connected("security", "logstash:5043")
+	m.Connected("security", "backup:5043")
+	m.Disconnected("security", "backup:5043")
+	m.Acknowledged(file.Name(), 4, false)
+
+	var output bytes.Buffer
+	m.WritePrometheus(&output)
+
+	for _, expected := range []string{
+		`logstash_forwarder_lines_read_total{file="C:\\logs\\\"app\".log"} 2`,
+		`logstash_forwarder_bytes_read_total{file="C:\\logs\\\"app\".log"} 15`,
+		"logstash_forwarder_batches_published_total 1",
+		"logstash_forwarder_ack_latency_seconds_sum 0.5",
+		`logstash_forwarder_server_connected{output="network",server="logstash:5043"} 1`,
+		`logstash_forwarder_server_connected{output="security",server="logstash:5043"} 1`,
+		"logstash_forwarder_harvesters_open 1",
+		`logstash_forwarder_file_lag_bytes{file="` + file.Name() + `"} 6`,
+	} {
+		if !strings.Contains(output.String(), expected+"\n") {
+			t.Errorf("expected %s in:\n%s", expected, output.String())
+		}
+	}
+	if strings.Contains(output.String(), "backup:5043") {
+		t.Errorf("expected no disconnected server in:\n%s", output.String())
+	}
+
+	// Files are dropped once forgotten
+	m.Forget(`C:\logs\"app".log`)
+	output.Reset()
+	m.WritePrometheus(&output)
+	if strings.Contains(output.String(), "app") {
+		t.Errorf("expected nothing about a forgotten file in:\n%s", output.String())
+	}
+}
+
+func TestMetricsLagCompressed(t *testing.T) {
+	reading := write_temp(t, gzip_lines("one\ntwo\n"))
+	defer os.Remove(reading)
+	complete := write_temp(t, gzip_lines("one\ntwo\n"))
+	defer os.Remove(complete)
+
+	// Offsets in compressed files are of their decompressed content
+	m := NewMetrics()
+	m.Acknowledged(reading, 1000, false)
+	m.Acknowledged(complete, 1000, true)
+	lag := m.lag()
+	if _, found := lag[reading]; found {
+		t.Errorf("Expected no lag for a compressed file still being read, got %d", lag[reading])
+	}
+	if value, found := lag[complete]; !found || value != 0 {
+		t.Errorf("Expected no lag for a complete compressed file, got %v", lag)
+	}
+}
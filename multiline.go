@@ -0,0 +1,106 @@
+package main
+
+import (
+  "bytes"
+  "time"
+  "unicode/utf8"
+)
+
+// Multiline joins continuation lines, such as stack traces, into a single
+// event before it is shipped. Each harvester owns its own Multiline.
+type Multiline struct {
+  config  *MultilineConfig
+  pending *FileEvent /* the event being assembled, nil if none */
+  buffer  bytes.Buffer
+  lines   uint64
+  last    time.Time /* when the last line was added to the pending event */
+  max_bytes int /* the longest the combined text may be, 0 for no limit */
+}
+
+func NewMultiline(config *MultilineConfig, max_bytes int) *Multiline {
+  return &Multiline{config: config, max_bytes: max_bytes}
+}
+
+// Push adds a single line event and returns any events that are complete
+// as a result.
+func (m *Multiline) Push(event *FileEvent) (complete []*FileEvent) {
+  matched := m.config.pattern.MatchString(*event.Text) != m.config.Negate
+
+  if m.config.What == "next" {
+    // Matching lines belong to the line that follows them
+    m.add(event)
+    if !matched {
+      complete = append(complete, m.Flush())
+    }
+  } else {
+    // Matching lines belong to the line before them
+    if !matched && m.pending != nil {
+      complete = append(complete, m.Flush())
+    }
+    m.add(event)
+  }
+
+  if m.pending != nil && m.lines >= m.config.MaxLines {
+    complete = append(complete, m.Flush())
+  }
+  return
+}
+
+// Expired reports whether there is a pending event that has not received a
+// line for longer than the configured timeout.
+func (m *Multiline) Expired() bool {
+  return m.pending != nil && time.Since(m.last) >= m.config.timeout
+}
+
+// Flush returns the pending event, or nil if there is none.
+func (m *Multiline) Flush() *FileEvent {
+  event := m.pending
+  if event == nil {
+    return nil
+  }
+
+  text := m.buffer.String()
+  event.Text = &text
+
+  m.pending = nil
+  m.buffer.Reset()
+  m.lines = 0
+  return event
+}
+
+func (m *Multiline) add(event *FileEvent) {
+  m.last = time.Now()
+
+  if m.pending == nil {
+    // The first line provides the offset and line number of the whole event
+    m.pending = event
+    m.write(*event.Text)
+    m.lines = 1
+    return
+  }
+
+  m.write("\n" + *event.Text)
+  m.pending.RawLength += event.RawLength
+  m.pending.LastLine = event.Line
+  m.pending.Truncated = m.pending.Truncated || event.Truncated
+  m.lines++
+}
+
+// write adds text to the pending event. Text beyond max bytes is dropped and
+// the event flagged as truncated, though the lines it came from still count
+// towards the event's length in the file.
+func (m *Multiline) write(text string) {
+  if m.max_bytes > 0 && m.buffer.Len()+len(text) > m.max_bytes {
+    room := m.max_bytes - m.buffer.Len()
+    if room < 0 {
+      room = 0
+    }
+    // Don't cut a character in half
+    for room > 0 && !utf8.RuneStart(text[room]) {
+      room--
+    }
+    text = text[:room]
+    m.pending.Truncated = true
+  }
+  m.buffer.WriteString(text)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+)
+
+func multilineEvents(texts ...string) []*FileEvent {
+	events := make([]*FileEvent, 0, len(texts))
+	var offset int64
+	for i, text := range texts {
+		text := text
+		events = append(events, &FileEvent{
+			Offset:    offset,
+			Line:      uint64(i + 1),
+			Text:      &text,
+			RawLength: int64(len(text) + 1),
+		})
+		offset += int64(len(text) + 1)
+	}
+	return events
+}
+
+func pushAll(m *Multiline, events []*FileEvent) (complete []*FileEvent) {
+	for _, event := range events {
+		complete = append(complete, m.Push(event)...)
+	}
+	return
+}
+
+func newTestMultiline(t *testing.T, config MultilineConfig) *Multiline {
+	if err := config.init(); err != nil {
+		t.Fatal(err)
+	}
+	return NewMultiline(&config, 0)
+}
+
+func TestMultilinePrevious(t *testing.T) {
+	m := newTestMultiline(t, MultilineConfig{Pattern: `^\s`})
+	complete := pushAll(m, multilineEvents(
+		"Exception in thread main",
+		"  at Foo.bar",
+		"  at Foo.main",
+		"next event",
+	))
+
+	if len(complete) != 1 {
+		t.Fatalf("expected 1 complete event, got %d", len(complete))
+	}
+	if *complete[0].Text != "Exception in thread main\n  at Foo.bar\n  at Foo.main" {
+		t.Errorf("unexpected text: %q", *complete[0].Text)
+	}
+	if complete[0].Offset != 0 || complete[0].Line != 1 || complete[0].last_line() != 3 {
+		t.Errorf("unexpected offset/lines: %d/%d-%d", complete[0].Offset, complete[0].Line, complete[0].last_line())
+	}
+	// The next event must start exactly where the combined event ends
+	if complete[0].RawLength != 25+13+14 {
+		t.Errorf("unexpected raw length: %d", complete[0].RawLength)
+	}
+
+	last := m.Flush()
+	if last == nil || *last.Text != "next event" || last.Offset != complete[0].RawLength {
+		t.Errorf("unexpected pending event: %+v", last)
+	}
+}
+
+func TestMultilineNextNegate(t *testing.T) {
+	// Lines not ending in a semicolon continue on the next line
+	m := newTestMultiline(t, MultilineConfig{Pattern: `;$`, Negate: true, What: "next"})
+	complete := pushAll(m, multilineEvents("a", "b;", "c;"))
+
+	if len(complete) != 2 {
+		t.Fatalf("expected 2 complete events, got %d", len(complete))
+	}
+	if *complete[0].Text != "a\nb;" || *complete[1].Text != "c;" {
+		t.Errorf("unexpected texts: %q %q", *complete[0].Text, *complete[1].Text)
+	}
+	if m.Flush() != nil {
+		t.Errorf("expected no pending event")
+	}
+}
+
+func TestMultilineMaxLines(t *testing.T) {
+	m := newTestMultiline(t, MultilineConfig{Pattern: `^\s`, MaxLines: 2})
+	complete := pushAll(m, multilineEvents("a", " b", " c"))
+
+	if len(complete) != 1 || *complete[0].Text != "a\n b" {
+		t.Fatalf("expected max lines to force a flush, got %d events", len(complete))
+	}
+}
+
+func TestMultilineConfigInvalid(t *testing.T) {
+	config := MultilineConfig{Pattern: "x", What: "sideways"}
+	if err := config.init(); err == nil {
+		t.Errorf("expected an invalid 'what' to be rejected")
+	}
+}
+
+func TestMultilineMaxBytes(t *testing.T) {
+	config := MultilineConfig{Pattern: `^\s`}
+	if err := config.init(); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMultiline(&config, 20)
+	complete := pushAll(m, multilineEvents(
+		"Exception: é",
+		"  at Foo.bar",
+		"  at Foo.main",
+		"next event",
+	))
+
+	if len(complete) != 1 {
+		t.Fatalf("expected 1 complete event, got %d", len(complete))
+	}
+	// Cut short without splitting a character, but still covering every line
+	if *complete[0].Text != "Exception: é\n  at F" || !complete[0].Truncated {
+		t.Errorf("expected the text cut short at 20 bytes and flagged, got %q, %v", *complete[0].Text, complete[0].Truncated)
+	}
+	if complete[0].last_line() != 3 || complete[0].RawLength != 14+13+14 {
+		t.Errorf("unexpected lines/raw length: %d/%d", complete[0].last_line(), complete[0].RawLength)
+	}
+	if next := m.Flush(); *next.Text != "next event" || next.Truncated {
+		t.Errorf("expected the next event untouched, got %q", *next.Text)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+  "log"
+  "path/filepath"
+  "sync"
+)
+
+// An Output is a destination for events with its own spooler and publisher,
+// so a slow or unreachable destination doesn't hold up files shipped to the
+// others.
+type Output struct {
+  Name string /* "" for the "network" section */
+  Events chan *FileEvent /* harvesters of the files routed here ship to this */
+  network chan *NetworkConfig /* new network configurations on reload */
+}
+
+// StartOutputs starts the pipeline of each output in the config. Events are
+// passed on to registrar once the output they were routed to has made them
+// safe, by having them acknowledged or by writing them to its disk spool.
+// registrar is closed once every output has shut down.
+func StartOutputs(config *Config, registrar chan []*FileEvent) map[string]*Output {
+  outputs := make(map[string]*Output)
+  var running sync.WaitGroup
+
+  for name, network := range config.output_configs() {
+    output := &Output{
+      Name: name,
+      Events: make(chan *FileEvent, 16),
+      network: make(chan *NetworkConfig, 1),
+    }
+    outputs[name] = output
+    log.Printf("Starting output %s to %v\n", output_name(name), network.Servers)
+
+    acked := make(chan []*FileEvent, 1)
+    output.start(network, acked)
+
+    running.Add(1)
+    go func() {
+      defer running.Done()
+      for events := range acked {
+        registrar <- events
+      }
+    }()
+  }
+
+  go func() {
+    running.Wait()
+    close(registrar)
+  }()
+  return outputs
+}
+
+func (o *Output) start(network *NetworkConfig, registrar chan []*FileEvent) {
+  publisher_chan := make(chan []*FileEvent, 1)
+
+  if *disk_spool != "" {
+    // Named outputs keep their own spools in a directory each
+    path := *disk_spool
+    if o.Name != "" {
+      path = filepath.Join(path, o.Name)
+    }
+    spool, err := OpenDiskSpool(path, *disk_spool_size, *disk_spool_segment_size)
+    if err != nil {
+      log.Fatalf("Failed to open disk spool: %s\n", err)
+    }
+    spool_chan := make(chan []*FileEvent, 1)
+    ack_chan := make(chan []*FileEvent, 1)
+
+    // Harvesters dump events into the spooler, which writes them to disk.
+    // The registrar is told once events are on disk, and the disk spool
+    // only forgets them once the publisher has had them acknowledged.
+    go Spool(o.Events, spool_chan, *spool_size, *idle_timeout)
+    go spool.Write(spool_chan, registrar)
+    go spool.Read(publisher_chan, *spool_size)
+    go spool.Acknowledge(ack_chan)
+
+    go Publishv1(publisher_chan, ack_chan, network, o.network)
+  } else {
+    // Harvesters dump events into the spooler.
+    go Spool(o.Events, publisher_chan, *spool_size, *idle_timeout)
+
+    go Publishv1(publisher_chan, registrar, network, o.network)
+  }
+}
+
+// output_name returns a name to log an output by.
+func output_name(name string) string {
+  if name == "" {
+    return "network"
+  }
+  return name
+}
@@ -4,6 +4,7 @@ import (
   "log"
   "os"
   "path/filepath"
+  "sync"
   "time"
 )
 
@@ -14,8 +15,9 @@ type ProspectorResume struct {
 
 type ProspectorInfo struct {
   fileinfo os.FileInfo /* the file info */
-  harvester chan int64 /* the harvester will send an event with its offset when it closes */
+  harvester chan *FileState /* the harvester will send its offset and line number when it closes */
   last_seen uint32 /* int number of the last iterations in which we saw this file */
+  fingerprint *Fingerprint /* of the start of the file, if fingerprint bytes is set */
 }
 
 type Prospector struct {
@@ -23,20 +25,49 @@ type Prospector struct {
   prospectorinfo map[string]ProspectorInfo
   iteration      uint32
   lastscan       time.Time
+  paths          []string /* the paths to scan, excluding stdin */
+  changes        chan struct{} /* notified when files appear in watched directories */
+  stop           chan bool
+  done           chan bool
+  harvesters     sync.WaitGroup
+}
+
+func NewProspector(fileconfig FileConfig) *Prospector {
+  fileconfig.scan_interval = default_interval(fileconfig.scan_interval, default_FileConfig_ScanInterval)
+  fileconfig.poll_interval = default_interval(fileconfig.poll_interval, default_FileConfig_PollInterval)
+  return &Prospector{
+    FileConfig: fileconfig,
+    changes: make(chan struct{}, 1),
+    stop: make(chan bool),
+    done: make(chan bool),
+  }
+}
+
+// default_interval returns interval, or the default if it's unset, as it is
+// in configs that weren't loaded from a file. Waiting no time at all between
+// checks would spin.
+func default_interval(interval time.Duration, default_value string) time.Duration {
+  if interval > 0 {
+    return interval
+  }
+  interval, _ = time.ParseDuration(default_value)
+  return interval
 }
 
 func (p *Prospector) Prospect(resume *ProspectorResume, output chan *FileEvent) {
+  defer close(p.done)
+  defer watcher.Unwatch(p.changes)
   p.prospectorinfo = make(map[string]ProspectorInfo)
 
   // Handle any "-" (stdin) paths
-  for i, path := range p.FileConfig.Paths {
+  for _, path := range p.FileConfig.Paths {
     if path == "-" {
       // Offset and Initial never get used when path is "-"
-      harvester := Harvester{Path: path, FileConfig: p.FileConfig}
+      // Not waited for on Stop, as a read from stdin can't be interrupted
+      harvester := &Harvester{Path: path, FileConfig: p.FileConfig, StopChan: p.stop}
       go harvester.Harvest(output)
-
-      // Remove it from the file list
-      p.FileConfig.Paths = append(p.FileConfig.Paths[:i], p.FileConfig.Paths[i+1:]...)
+    } else {
+      p.paths = append(p.paths, path)
     }
   }
 
@@ -44,7 +75,7 @@ func (p *Prospector) Prospect(resume *ProspectorResume, output chan *FileEvent)
   p.lastscan = time.Now()
 
   // Now let's do one quick scan to pick up new files
-  for _, path := range p.FileConfig.Paths {
+  for _, path := range p.paths {
     p.scan(path, output, resume)
   }
 
@@ -57,15 +88,20 @@ func (p *Prospector) Prospect(resume *ProspectorResume, output chan *FileEvent)
   for {
     newlastscan := time.Now()
 
-    for _, path := range p.FileConfig.Paths {
+    for _, path := range p.paths {
       // Scan - flag false so new files always start at beginning
       p.scan(path, output, nil)
     }
 
     p.lastscan = newlastscan
 
-    // Defer next scan for a bit.
-    time.Sleep(10 * time.Second) // Make this tunable
+    // Defer next scan for a bit, or until a new file shows up
+    select {
+    case <-p.stop:
+      return
+    case <-p.changes:
+    case <-time.After(p.FileConfig.scan_interval):
+    }
 
     // Clear out files that disappeared and we've stopped harvesting
     for file, lastinfo := range p.prospectorinfo {
@@ -78,21 +114,75 @@ func (p *Prospector) Prospect(resume *ProspectorResume, output chan *FileEvent)
   }
 } /* Prospect */
 
+func (p *Prospector) launch(harvester *Harvester, output chan *FileEvent) {
+  p.harvesters.Add(1)
+  go func() {
+    defer p.harvesters.Done()
+    harvester.Harvest(output)
+  }()
+}
+
+// Stop stops the prospector and all of its harvesters. It returns the state
+// of each file that was being harvested, so that another prospector can
+// resume where this one left off.
+func (p *Prospector) Stop() map[string]*FileState {
+  close(p.stop)
+  <-p.done
+
+  // Renamed files share a harvester channel with their old name, so only
+  // take the offset once, for the most recently seen name
+  latest := make(map[chan *FileState]string)
+  for file, info := range p.prospectorinfo {
+    if previous, found := latest[info.harvester]; found && p.prospectorinfo[previous].last_seen >= info.last_seen {
+      continue
+    }
+    latest[info.harvester] = file
+  }
+
+  states := make(map[string]*FileState)
+  for harvester, file := range latest {
+    // Each harvester sends its final offset when it finishes
+    file := file
+    info := p.prospectorinfo[file]
+    ino, dev := file_ids(&info.fileinfo)
+    position := <-harvester
+    states[file] = &FileState{
+      Source: &file,
+      Offset: position.Offset,
+      Line:   position.Line,
+      Inode:  ino,
+      Device: dev,
+      Fingerprint: position.Fingerprint,
+      Complete: position.Complete,
+    }
+  }
+
+  // Wait for harvesters still reading files that have since rotated away
+  p.harvesters.Wait()
+  return states
+}
+
 func (p *Prospector) scan(path string, output chan *FileEvent, resume *ProspectorResume) {
   //log.Printf("Prospecting %s\n", path)
 
-  // Evaluate the path as a wildcards/shell glob
-  matches, err := filepath.Glob(path)
+  // Evaluate the path as a wildcards/shell glob, which may recurse with "**"
+  matches, err := Glob(path)
   if err != nil {
     log.Printf("glob(%s) failed: %v\n", path, err)
     return
   }
 
+  p.watch(path, matches)
+
   // To keep the old inode/dev reference if we see a file has renamed, in case it was also renamed prior
   missinginfo := make(map[string]os.FileInfo)
 
   // Check any matched files to see if we need to start a harvester
   for _, file := range matches {
+    if p.FileConfig.IsExcluded(file) {
+      continue
+    }
+
     // Stat the file, following any symlinks.
     fileinfo, err := os.Stat(file)
     // TODO(sissel): check err
@@ -115,55 +205,76 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
     // - the file's inode or device changed
     if !is_known {
       // Create a new prospector info with the stat info for comparison
-      newinfo = ProspectorInfo{fileinfo: fileinfo, harvester: make(chan int64, 1), last_seen: p.iteration}
+      newinfo = ProspectorInfo{fileinfo: fileinfo, harvester: make(chan *FileState, 1), last_seen: p.iteration}
+      _, newinfo.fingerprint = check_fingerprint(file, nil, p.fingerprint_bytes())
 
       // Check for dead time, but only if the file modification time is before the last scan started
       // This ensures we don't skip genuine creations with dead times less than 10s
       if fileinfo.ModTime().Before(p.lastscan) && time.Since(fileinfo.ModTime()) > p.FileConfig.deadtime {
-        var offset int64 = 0
-        var is_resuming bool = false
+        var last_state *FileState
 
         if resume != nil {
           // Call the calculator - it will process resume state if there is one
-          offset, is_resuming = p.calculate_resume(file, fileinfo, resume)
+          last_state = p.calculate_resume(file, fileinfo, resume)
         }
 
         // Are we resuming a dead file? We have to resume even if dead so we catch any old updates to the file
         // This is safe as the harvester, once it hits the EOF and a timeout, will stop harvesting
         // Once we detect changes again we can resume another harvester again - this keeps number of go routines to a minimum
-        if is_resuming {
+        if last_state != nil && last_state.Complete {
+          log.Printf("Skipping compressed file (already harvested): %s\n", file)
+          newinfo.harvester <- last_state
+        } else if last_state != nil {
           log.Printf("Resuming harvester on a previously harvested file: %s\n", file)
-          harvester := &Harvester{Path: file, FileConfig: p.FileConfig, Offset: offset, FinishChan: newinfo.harvester}
-          go harvester.Harvest(output)
+          harvester := &Harvester{Path: file, FileConfig: p.FileConfig, Offset: last_state.Offset, Line: last_state.Line, FinishChan: newinfo.harvester, StopChan: p.stop}
+          p.launch(harvester, output)
+        } else if p.compression(file) != compression_none {
+          // Old compressed file, skip it all, as its offsets aren't those of the file on disk
+          log.Printf("Skipping compressed file (older than dead time of %v): %s\n", p.FileConfig.deadtime, file)
+          newinfo.harvester <- &FileState{Fingerprint: newinfo.fingerprint, Complete: true}
         } else {
           // Old file, skip it, but push offset of file size so we start from the end if this file changes and needs picking up
           log.Printf("Skipping file (older than dead time of %v): %s\n", p.FileConfig.deadtime, file)
-          newinfo.harvester <- fileinfo.Size()
+          newinfo.harvester <- &FileState{Offset: fileinfo.Size(), Fingerprint: newinfo.fingerprint}
         }
-      } else if previous := is_file_renamed(file, fileinfo, p.prospectorinfo, missinginfo); previous != "" {
+      } else if previous := p.renamed_from(file, fileinfo, missinginfo); previous != "" {
         // This file was simply renamed (known inode+dev) - link the same harvester channel as the old file
         log.Printf("File rename was detected: %s -> %s\n", previous, file)
 
+        newinfo.harvester = p.prospectorinfo[previous].harvester
+        newinfo.fingerprint = p.prospectorinfo[previous].fingerprint
+      } else if previous := p.find_compressed_original(file); previous != "" {
+        // A file we know was compressed - link the same harvester channel, so
+        // the compressed file is only read from where the harvester of the
+        // original stops, if it changes after that
+        log.Printf("File compression was detected: %s -> %s\n", previous, file)
+
         newinfo.harvester = p.prospectorinfo[previous].harvester
       } else {
-        var offset int64 = 0
-        var is_resuming bool = false
+        last_state := &FileState{}
 
         if resume != nil {
           // Call the calculator - it will process resume state if there is one
-          offset, is_resuming = p.calculate_resume(file, fileinfo, resume)
+          if resumed := p.calculate_resume(file, fileinfo, resume); resumed != nil {
+            last_state = resumed
+          }
         }
 
         // Are we resuming a file or is this a completely new file?
-        if is_resuming {
-          log.Printf("Resuming harvester on a previously harvested file: %s\n", file)
+        if last_state.Complete {
+          log.Printf("Skipping compressed file (already harvested): %s\n", file)
+          newinfo.harvester <- last_state
         } else {
-          log.Printf("Launching harvester on new file: %s\n", file)
+          if last_state.Source != nil {
+            log.Printf("Resuming harvester on a previously harvested file: %s\n", file)
+          } else {
+            log.Printf("Launching harvester on new file: %s\n", file)
+          }
+
+          // Launch the harvester
+          harvester := &Harvester{Path: file, FileConfig: p.FileConfig, Offset: last_state.Offset, Line: last_state.Line, FinishChan: newinfo.harvester, StopChan: p.stop}
+          p.launch(harvester, output)
         }
-
-        // Launch the harvester
-        harvester := &Harvester{Path: file, FileConfig: p.FileConfig, Offset: offset, FinishChan: newinfo.harvester}
-        go harvester.Harvest(output)
       }
     } else {
       // Update the fileinfo information used for future comparisons, and the last_seen counter
@@ -171,35 +282,47 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
       newinfo.last_seen = p.iteration
 
       if !is_fileinfo_same(lastinfo.fileinfo, fileinfo) {
-        if previous := is_file_renamed(file, fileinfo, p.prospectorinfo, missinginfo); previous != "" {
+        if previous := p.renamed_from(file, fileinfo, missinginfo); previous != "" {
           // This file was renamed from another file we know - link the same harvester channel as the old file
           log.Printf("File rename was detected: %s -> %s\n", previous, file)
           log.Printf("Launching harvester on renamed file: %s\n", file)
 
           newinfo.harvester = p.prospectorinfo[previous].harvester
+          newinfo.fingerprint = p.prospectorinfo[previous].fingerprint
         } else {
           // File is not the same file we saw previously, it must have rotated and is a new file
           log.Printf("Launching harvester on rotated file: %s\n", file)
 
           // Forget about the previous harvester and let it continue on the old file - so start a new channel to use with the new harvester
-          newinfo.harvester = make(chan int64, 1)
+          newinfo.harvester = make(chan *FileState, 1)
+          _, newinfo.fingerprint = check_fingerprint(file, nil, p.fingerprint_bytes())
 
           // Start a harvester on the path
-          harvester := &Harvester{Path: file, FileConfig: p.FileConfig, FinishChan: newinfo.harvester}
-          go harvester.Harvest(output)
+          harvester := &Harvester{Path: file, FileConfig: p.FileConfig, FinishChan: newinfo.harvester, StopChan: p.stop}
+          p.launch(harvester, output)
         }
 
         // Keep the old file in missinginfo so we don't rescan it if it was renamed and we've not yet reached the new filename
         // We only need to keep it for the remainder of this iteration then we can assume it was deleted and forget about it
         missinginfo[file] = lastinfo.fileinfo
       } else if len(newinfo.harvester) != 0 && lastinfo.fileinfo.ModTime() != fileinfo.ModTime() {
-        // Resume harvesting of an old file we've stopped harvesting from
-        log.Printf("Resuming harvester on an old file that was just modified: %s\n", file)
-
         // Start a harvester on the path; an old file was just modified and it doesn't have a harvester
         // The offset to continue from will be stored in the harvester channel - so take that to use and also clear the channel
-        harvester := &Harvester{Path: file, FileConfig: p.FileConfig, Offset: <-newinfo.harvester, FinishChan: newinfo.harvester}
-        go harvester.Harvest(output)
+        position := <-newinfo.harvester
+
+        var matches bool
+        matches, newinfo.fingerprint = check_fingerprint(file, position.Fingerprint, p.fingerprint_bytes())
+        if matches {
+          // Resume harvesting of an old file we've stopped harvesting from
+          log.Printf("Resuming harvester on an old file that was just modified: %s\n", file)
+        } else {
+          // A new file that took the inode of the old one, or the old file
+          // truncated and written again
+          log.Printf("Launching harvester on replaced file (same inode, different content): %s\n", file)
+          position = &FileState{}
+        }
+        harvester := &Harvester{Path: file, FileConfig: p.FileConfig, Offset: position.Offset, Line: position.Line, FinishChan: newinfo.harvester, StopChan: p.stop}
+        p.launch(harvester, output)
       }
     }
 
@@ -209,17 +332,40 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
   } // for each file matched by the glob
 }
 
-func (p *Prospector) calculate_resume(file string, fileinfo os.FileInfo, resume *ProspectorResume) (int64, bool) {
+// watch asks to hear about new files in the directories a path matches files
+// in, and in the path's own directory if it has no wildcards. New directories
+// matched by wildcards are only found by the next scan.
+func (p *Prospector) watch(path string, matches []string) {
+  if watcher == nil {
+    return
+  }
+
+  directories := make(map[string]bool)
+  if directory := filepath.Dir(path); !has_meta(directory) {
+    directories[directory] = true
+  }
+  for _, file := range matches {
+    directories[filepath.Dir(file)] = true
+  }
+  for directory := range directories {
+    // Missing directories are picked up by a later scan
+    watcher.Watch(directory, p.changes)
+  }
+}
+
+// calculate_resume returns the saved state to resume a file from, or nil if
+// there is none.
+func (p *Prospector) calculate_resume(file string, fileinfo os.FileInfo, resume *ProspectorResume) *FileState {
   last_state, is_found := resume.files[file]
 
-  if is_found && is_file_same(file, fileinfo, last_state) {
+  if is_found && is_file_same(file, fileinfo, last_state) && p.is_content_same(file, last_state) {
     // We're resuming - throw the last state back downstream so we resave it
     // And return the offset - also force harvest in case the file is old and we're about to skip it
     resume.persist <- last_state
-    return last_state.Offset, true
+    return last_state
   }
 
-  if previous := is_file_renamed_resumelist(file, fileinfo, resume.files); previous != "" {
+  if previous := is_file_renamed_resumelist(file, fileinfo, resume.files); previous != "" && p.is_content_same(file, resume.files[previous]) {
     // File has rotated between shutdown and startup
     // We return last state downstream, with a modified event source with the new file name
     // And return the offset - also force harvest in case the file is old and we're about to skip it
@@ -227,7 +373,25 @@ func (p *Prospector) calculate_resume(file string, fileinfo os.FileInfo, resume
     last_state := resume.files[previous]
     last_state.Source = &file
     resume.persist <- last_state
-    return last_state.Offset, true
+    return last_state
+  }
+
+  if p.FileConfig.FingerprintBytes > 0 && p.compression(file) != compression_none {
+    fingerprints := make(map[string]*Fingerprint, len(resume.files))
+    for name, state := range resume.files {
+      fingerprints[name] = state.Fingerprint
+    }
+    if previous := find_original(file, fingerprints, p.fingerprint_bytes()); previous != "" {
+      // File was compressed between shutdown and startup, so carry on from
+      // where we were in the original
+      log.Printf("Detected compression of a previously harvested file: %s -> %s\n", previous, file)
+      ino, dev := file_ids(&fileinfo)
+      last_state := *resume.files[previous]
+      last_state.Source = &file
+      last_state.Inode, last_state.Device = ino, dev
+      resume.persist <- &last_state
+      return &last_state
+    }
   }
 
   if is_found {
@@ -235,5 +399,57 @@ func (p *Prospector) calculate_resume(file string, fileinfo os.FileInfo, resume
   }
 
   // New file so just start from an automatic position
-  return 0, false
+  return nil
+}
+
+// compression returns the format a file is compressed in, if it is to be
+// decompressed.
+func (p *Prospector) compression(file string) string {
+  if !p.FileConfig.Decompress {
+    return compression_none
+  }
+  f, err := os.Open(file)
+  if err != nil {
+    return compression_none
+  }
+  defer f.Close()
+  return detect_compression(f, file)
+}
+
+// find_compressed_original looks for a known file that a new compressed file
+// was compressed from, if fingerprints are in use.
+func (p *Prospector) find_compressed_original(file string) string {
+  if p.FileConfig.FingerprintBytes == 0 || p.compression(file) == compression_none {
+    return ""
+  }
+  fingerprints := make(map[string]*Fingerprint, len(p.prospectorinfo))
+  for name, info := range p.prospectorinfo {
+    fingerprints[name] = info.fingerprint
+  }
+  return find_original(file, fingerprints, p.fingerprint_bytes())
+}
+
+// is_content_same reports whether a file still starts with the content saved
+// in its state, if fingerprints are in use.
+func (p *Prospector) is_content_same(file string, state *FileState) bool {
+  return p.FileConfig.FingerprintBytes == 0 || is_fingerprint_same(file, state)
+}
+
+// renamed_from returns the known file that file was renamed from, or "" if
+// it wasn't. With fingerprints the content must match too, as a new file can
+// take the inode of one that was deleted.
+func (p *Prospector) renamed_from(file string, fileinfo os.FileInfo, missinginfo map[string]os.FileInfo) string {
+  previous := is_file_renamed(file, fileinfo, p.prospectorinfo, missinginfo)
+  if previous == "" || p.FileConfig.FingerprintBytes == 0 {
+    return previous
+  }
+  if matches, _ := check_fingerprint(file, p.prospectorinfo[previous].fingerprint, p.fingerprint_bytes()); !matches {
+    log.Printf("Not a rename, %s has the inode of %s but different content\n", file, previous)
+    return ""
+  }
+  return previous
+}
+
+func (p *Prospector) fingerprint_bytes() int64 {
+  return int64(p.FileConfig.FingerprintBytes)
 }
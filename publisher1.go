@@ -4,16 +4,14 @@ import (
   "bytes"
   "compress/zlib"
   "crypto/tls"
-  "crypto/x509"
   "encoding/binary"
-  "encoding/pem"
   "fmt"
   "io"
-  "io/ioutil"
   "log"
   "math/rand"
   "net"
   "os"
+  "reflect"
   "regexp"
   "strconv"
   "time"
@@ -32,217 +30,588 @@ func init() {
   rand.Seed(time.Now().UnixNano())
 }
 
+// A payload is a batch of events sent in a single compressed frame. It is
+// kept until the server acknowledges every event in it, so it can be resent
+// on a new connection.
+//
+// Events without text only carry a file position for the registrar, such as
+// the end of lines the harvester dropped. They are not sent, but are released
+// to the registrar in order with the events around them.
+type payload struct {
+  events   []*FileEvent
+  data     uint32 /* number of events with text, sent as data frames */
+  sequence uint32 /* sequence number of the first data frame */
+  frame    []byte /* window and compressed frames ready to send */
+  sent     time.Time
+}
+
+// A connection to a server, with the payloads sent on it that are waiting
+// for acknowledgement.
+type connection struct {
+  output   string /* name of the output it belongs to, for the metrics */
+  server   *server
+  socket   net.Conn
+  sequence uint32
+  pending  []*payload /* oldest first */
+  last_progress time.Time
+  retiring bool /* no more payloads are sent on it, it's closed once they're all acknowledged */
+  done     chan bool /* closed when the connection is closed, to stop its ack reader */
+}
+
+// Something that happened on a connection: an ack, or an error reading one.
+type connection_event struct {
+  connection *connection
+  ack        uint32
+  err        error
+}
+
+// The outcome of connecting to a server.
+type connect_result struct {
+  pool   *ServerPool
+  server *server
+  socket net.Conn
+  err    error
+}
+
 func Publishv1(input chan []*FileEvent,
   registrar chan []*FileEvent,
-  config *NetworkConfig) {
-  var buffer bytes.Buffer
-  var socket *tls.Conn
-  var sequence uint32
-  var err error
+  config *NetworkConfig,
+  reload chan *NetworkConfig) {
+  pool := NewServerPool(config)
+  material := NewTLSMaterial(config)
+  var connections []*connection
+  connecting := make(map[*server]bool)
+  connected := make(chan connect_result, 1)
+  events := make(chan connection_event, 16)
+
+  // Payloads whose connection failed, to send again on another
+  var unsent []*payload
+  // Events in the order they were published, so they are released in that
+  // order however the connections they were sent on are acknowledged
+  order := new_release_order()
+
+  defer func() {
+    for _, c := range connections {
+      c.close()
+    }
+    material.Close()
+  }()
+
+  // Connect in the background, so a server that is down doesn't hold up
+  // the others
+  start_connect := func(server *server) {
+    connecting[server] = true
+    go func(pool *ServerPool, config *NetworkConfig, material *TLSMaterial) {
+      socket, err := connect_server(config, material, server.hostport)
+      connected <- connect_result{pool, server, socket, err}
+    }(pool, config, material)
+  }
 
-  socket = connect(config)
-  defer socket.Close()
+  // Close a connection that failed, hold its server back and send its
+  // unacknowledged payloads again on another connection
+  fail := func(c *connection, err error) {
+    hold := pool.failed(c.server, time.Now())
+    log.Printf("Socket error on %s, will try it again in %v (failure %d in a row): %s\n",
+      c.server.hostport, hold, c.server.backoff.Failures(), err)
+    c.close()
+    metrics.Reconnecting()
+    unsent = append(unsent, c.pending...)
+    connections = remove_connection(connections, c)
+  }
 
-  for events := range input {
-    buffer.Truncate(0)
-    compressor, _ := zlib.NewWriterLevel(&buffer, 3)
+  release := func(events []*FileEvent) {
+    // Tell the registrar that we've successfully sent these events
+    if released := order.ack(events); len(released) > 0 {
+      registrar <- released
+    }
+  }
 
-    for _, event := range events {
-      sequence += 1
-      writeDataFrame(event, sequence, compressor)
+  for {
+    now := time.Now()
+
+    // Connect to as many servers as the strategy sends to
+    in_use := make(map[*server]bool)
+    active := len(connecting)
+    for _, c := range connections {
+      in_use[c.server] = true
+      if !c.retiring {
+        active++
+      }
     }
-    compressor.Flush()
-    compressor.Close()
-
-    compressed_payload := buffer.Bytes()
-
-    // Send buffer until we're successful...
-    oops := func(err error) {
-      // TODO(sissel): Track how frequently we timeout and reconnect. If we're
-      // timing out too frequently, there's really no point in timing out since
-      // basically everything is slow or down. We'll want to ratchet up the
-      // timeout value slowly until things improve, then ratchet it down once
-      // things seem healthy.
-      log.Printf("Socket error, will reconnect: %s\n", err)
-      time.Sleep(1 * time.Second)
-      socket.Close()
-      socket = connect(config)
+    for server := range connecting {
+      in_use[server] = true
+    }
+    if pool.strategy == strategy_failover {
+      // Go back to a server earlier in the list once it isn't held back
+      if preferred := pool.choose(nil, now); preferred != nil && len(connecting) == 0 &&
+        (active == 0 || preferred.index < connections[len(connections)-1].server.index) {
+        start_connect(preferred)
+      }
+    } else {
+      for ; active < pool.connections(); active++ {
+        server := pool.choose(in_use, now)
+        if server == nil {
+          break
+        }
+        in_use[server] = true
+        start_connect(server)
+      }
+    }
+
+    // Send payloads that lost their connection first, renumbered for the
+    // new one
+    for len(unsent) > 0 {
+      c := pool.pick(connections, config.MaxPendingPayloads)
+      if c == nil {
+        break
+      }
+      p := unsent[0]
+      unsent = unsent[1:]
+      pool.sent(c)
+      if err := c.send(p, config.timeout); err != nil {
+        fail(c, err)
+      }
     }
 
-  SendPayload:
-    for {
-      // Abort if our whole request takes longer than the configured
-      // network timeout.
-      socket.SetDeadline(time.Now().Add(config.timeout))
+    // Only accept new events while a connection has room for them
+    var ready chan []*FileEvent
+    if len(unsent) == 0 && has_room(connections, config.MaxPendingPayloads) {
+      ready = input
+    }
 
-      // Set the window size to the length of this payload in events.
-      _, err = socket.Write([]byte("1W"))
-      if err != nil {
-        oops(err)
+    pending := len(unsent)
+    var deadline *connection
+    for _, c := range connections {
+      pending += len(c.pending)
+      if len(c.pending) > 0 && (deadline == nil || c.last_progress.Before(deadline.last_progress)) {
+        deadline = c
+      }
+    }
+    if pending == 0 && input == nil {
+      // Input closed and everything has been acknowledged
+      close(registrar)
+      return
+    }
+
+    var timeout <-chan time.Time
+    if deadline != nil {
+      timeout = time.After(deadline.last_progress.Add(config.timeout).Sub(now))
+    }
+    var retry <-chan time.Time
+    if next := pool.next_retry(in_use); !next.IsZero() {
+      retry = time.After(next.Sub(now))
+    }
+
+    select {
+    case batch, ok := <-ready:
+      if !ok {
+        input = nil
         continue
       }
-      binary.Write(socket, binary.BigEndian, uint32(len(events)))
-      if err != nil {
-        oops(err)
+      order.add(batch)
+      if !has_text(batch) {
+        // Nothing to send or wait for
+        release(batch)
         continue
       }
-
-      // Write compressed frame
-      socket.Write([]byte("1C"))
-      if err != nil {
-        oops(err)
+      c := pool.pick(connections, config.MaxPendingPayloads)
+      pool.sent(c)
+      if err := c.send(&payload{events: batch}, config.timeout); err != nil {
+        fail(c, err)
+      }
+    case e := <-events:
+      c := e.connection
+      if c.socket == nil {
+        // Already closed
         continue
       }
-      binary.Write(socket, binary.BigEndian, uint32(len(compressed_payload)))
-      if err != nil {
-        oops(err)
+      if e.err != nil {
+        fail(c, e.err)
         continue
       }
-      _, err = socket.Write(compressed_payload)
+      var released []*FileEvent
+      var err error
+      c.pending, released, err = ackPayloads(c.pending, e.ack)
       if err != nil {
-        oops(err)
+        fail(c, err)
         continue
       }
-
-      // read ack
-      response := make([]byte, 0, 6)
-      ackbytes := 0
-      for ackbytes != 6 {
-        n, err := socket.Read(response[len(response):cap(response)])
-        if err != nil {
-          log.Printf("Read error looking for ack: %s\n", err)
-          socket.Close()
-          socket = connect(config)
-          continue SendPayload // retry sending on new connection
-        } else {
-          ackbytes += n
+      c.last_progress = time.Now()
+      pool.succeeded(c.server)
+      release(released)
+
+      if c.retiring && len(c.pending) == 0 {
+        log.Printf("Disconnecting from %s\n", c.server.hostport)
+        c.close()
+        connections = remove_connection(connections, c)
+      }
+    case r := <-connected:
+      if r.pool != pool {
+        // Connected with a configuration that has since been reloaded
+        if r.socket != nil {
+          r.socket.Close()
         }
+        continue
       }
-
-      // TODO(sissel): verify ack
-      // Success, stop trying to send the payload.
-      break
+      delete(connecting, r.server)
+      if r.err != nil {
+        hold := pool.failed(r.server, time.Now())
+        log.Printf("Failed to connect to %s, will try it again in %v (failure %d in a row): %s\n",
+          r.server.hostport, hold, r.server.backoff.Failures(), r.err)
+        continue
+      }
+      log.Printf("Connected to %s\n", r.server.hostport)
+      if pool.strategy == strategy_failover {
+        // Stop sending to the server failed over to
+        for _, c := range connections {
+          c.retiring = true
+          if len(c.pending) == 0 {
+            log.Printf("Disconnecting from %s\n", c.server.hostport)
+            c.close()
+          }
+        }
+        connections = remove_closed(connections)
+      }
+      connections = append(connections, new_connection(config.name, r.server, r.socket, events))
+    case <-timeout:
+      fail(deadline, fmt.Errorf("no ack received within %v", config.timeout))
+    case <-retry:
+      // A server is no longer held back
+    case newconfig := <-reload:
+      if reflect.DeepEqual(config, newconfig) {
+        continue
+      }
+      log.Printf("Network configuration changed, reconnecting\n")
+      config = newconfig
+      for _, c := range connections {
+        c.close()
+        unsent = append(unsent, c.pending...)
+      }
+      connections = nil
+      connecting = make(map[*server]bool)
+      pool = NewServerPool(config)
+      material.Close()
+      material = NewTLSMaterial(config)
     }
-
-    // Tell the registrar that we've successfully sent these events
-    registrar <- events
-  } /* for each event payload */
+  }
 } // Publish
 
-func connect(config *NetworkConfig) (socket *tls.Conn) {
-  var tlsconfig tls.Config
+func new_connection(output string, server *server, socket net.Conn, events chan connection_event) *connection {
+  c := &connection{
+    output: output,
+    server: server,
+    socket: socket,
+    last_progress: time.Now(),
+    done: make(chan bool),
+  }
+  // Ack timeouts are tracked by us, not by the socket
+  socket.SetReadDeadline(time.Time{})
+  go c.read_acks(events)
+  metrics.Connected(output, server.hostport)
+  return c
+}
 
-  if len(config.SSLCertificate) > 0 && len(config.SSLKey) > 0 {
-    log.Printf("Loading client ssl certificate: %s and %s\n",
-      config.SSLCertificate, config.SSLKey)
-    cert, err := tls.LoadX509KeyPair(config.SSLCertificate, config.SSLKey)
-    if err != nil {
-      log.Fatalf("Failed loading client ssl certificate: %s\n", err)
-    }
-    tlsconfig.Certificates = []tls.Certificate{cert}
+// send encodes a payload with the connection's next sequence numbers and
+// sends it.
+func (c *connection) send(p *payload, timeout time.Duration) error {
+  if len(c.pending) == 0 {
+    c.last_progress = time.Now()
   }
+  c.sequence = p.encode(c.sequence)
+  c.pending = append(c.pending, p)
+  return p.send(c.socket, timeout)
+}
 
-  if len(config.SSLCA) > 0 {
-    log.Printf("Setting trusted CA from file: %s\n", config.SSLCA)
-    tlsconfig.RootCAs = x509.NewCertPool()
+func (c *connection) close() {
+  if c.socket != nil {
+    close(c.done)
+    c.socket.Close()
+    c.socket = nil
+    metrics.Disconnected(c.output, c.server.hostport)
+  }
+}
 
-    pemdata, err := ioutil.ReadFile(config.SSLCA)
+// read_acks reads ack frames from the socket until it fails or the
+// connection is closed.
+func (c *connection) read_acks(events chan connection_event) {
+  socket, done := c.socket, c.done
+  response := make([]byte, 6)
+  for {
+    event := connection_event{connection: c}
+    _, err := io.ReadFull(socket, response)
+    if err == nil && (response[0] != '1' || response[1] != 'A') {
+      err = fmt.Errorf("unexpected frame %q while waiting for ack", response[0:2])
+    }
     if err != nil {
-      log.Fatalf("Failure reading CA certificate: %s\n", err)
+      event.err = err
+    } else {
+      event.ack = binary.BigEndian.Uint32(response[2:])
     }
 
-    block, _ := pem.Decode(pemdata)
-    if block == nil {
-      log.Fatalf("Failed to decode PEM data, is %s a valid cert?\n", config.SSLCA)
+    select {
+    case events <- event:
+    case <-done:
+      return
     }
-    if block.Type != "CERTIFICATE" {
-      log.Fatalf("This is not a certificate file: %s\n", config.SSLCA)
+    if err != nil {
+      return
     }
+  }
+}
 
-    cert, err := x509.ParseCertificate(block.Bytes)
-    if err != nil {
-      log.Fatalf("Failed to parse a certificate: %s\n", config.SSLCA)
+func has_text(events []*FileEvent) bool {
+  for _, event := range events {
+    if event.Text != nil {
+      return true
     }
-    tlsconfig.RootCAs.AddCert(cert)
   }
+  return false
+}
 
-  for {
-    // Pick a random server from the list.
-    hostport := config.Servers[rand.Int()%len(config.Servers)]
-    submatch := hostport_re.FindSubmatch([]byte(hostport))
-    if submatch == nil {
-      log.Fatalf("Invalid host:port given: %s", hostport)
+func remove_connection(connections []*connection, c *connection) []*connection {
+  for i, other := range connections {
+    if other == c {
+      return append(connections[:i:i], connections[i+1:]...)
     }
-    host := string(submatch[1])
-    port := string(submatch[2])
-    addresses, err := net.LookupHost(host)
+  }
+  return connections
+}
 
-    if err != nil {
-      log.Printf("DNS lookup failure \"%s\": %s\n", host, err)
-      time.Sleep(1 * time.Second)
-      continue
+func remove_closed(connections []*connection) []*connection {
+  var open []*connection
+  for _, c := range connections {
+    if c.socket != nil {
+      open = append(open, c)
     }
+  }
+  return open
+}
 
-    address := addresses[rand.Int()%len(addresses)]
-    var addressport string
+// A release_order passes acknowledged events on in the order they were
+// published. Payloads sent on different connections can be acknowledged in
+// any order, but the registrar must not move past events that aren't safe
+// yet.
+type release_order struct {
+  events []*FileEvent /* published and not yet released, oldest first */
+  acked  map[*FileEvent]bool
+}
 
-    ip := net.ParseIP(address)
-    if len(ip) == net.IPv4len {
-        addressport = fmt.Sprintf("%s:%s", address, port)
-    } else if len(ip) == net.IPv6len {
-        addressport = fmt.Sprintf("[%s]:%s", address, port)
-    }
+func new_release_order() *release_order {
+  return &release_order{acked: make(map[*FileEvent]bool)}
+}
 
-    log.Printf("Connecting to %s (%s) \n", addressport, host)
+func (r *release_order) add(events []*FileEvent) {
+  r.events = append(r.events, events...)
+}
 
-    tcpsocket, err := net.DialTimeout("tcp", addressport, config.timeout)
-    if err != nil {
-      log.Printf("Failure connecting to %s: %s\n", address, err)
-      time.Sleep(1 * time.Second)
+// ack marks events as acknowledged, and returns those that can be released:
+// every acknowledged event that no unacknowledged one was published before.
+func (r *release_order) ack(events []*FileEvent) []*FileEvent {
+  for _, event := range events {
+    r.acked[event] = true
+  }
+  i := 0
+  for ; i < len(r.events) && r.acked[r.events[i]]; i++ {
+    delete(r.acked, r.events[i])
+  }
+  released := r.events[:i:i]
+  r.events = r.events[i:]
+  return released
+}
+
+// encode compresses the payload's events using sequence numbers following
+// the given one, and returns the last sequence number used.
+func (p *payload) encode(sequence uint32) uint32 {
+  var buffer bytes.Buffer
+  compressor, _ := zlib.NewWriterLevel(&buffer, 3)
+
+  p.sequence = sequence + 1
+  p.data = 0
+  for _, event := range p.events {
+    if event.Text == nil {
       continue
     }
+    sequence += 1
+    p.data += 1
+    writeDataFrame(event, sequence, compressor)
+  }
+  compressor.Flush()
+  compressor.Close()
 
-    // tlsconfig.ServerName = host
-  
-    if !config.SSLStrict {
-      log.Println("WARNING: TLS: InsecureSkipVerify: you are susceptible to MITM attacks. ")
-      tlsconfig.InsecureSkipVerify = true
-      tlsconfig.ServerName = ""
-    } else {
-      tlsconfig.ServerName = host
+  if p.data == 0 {
+    p.frame = nil
+    return sequence
+  }
+
+  var frame bytes.Buffer
+  // Set the window size to the length of this payload in data frames.
+  frame.Write([]byte("1W"))
+  binary.Write(&frame, binary.BigEndian, p.data)
+
+  // Write compressed frame
+  frame.Write([]byte("1C"))
+  binary.Write(&frame, binary.BigEndian, uint32(buffer.Len()))
+  frame.Write(buffer.Bytes())
+
+  p.frame = frame.Bytes()
+  return sequence
+}
+
+func (p *payload) send(socket net.Conn, timeout time.Duration) error {
+  if len(p.frame) == 0 {
+    return nil
+  }
+
+  // Abort if writing the payload takes longer than the configured
+  // network timeout.
+  socket.SetWriteDeadline(time.Now().Add(timeout))
+  _, err := socket.Write(p.frame)
+  p.sent = time.Now()
+  return err
+}
+
+// ackPayloads releases every pending event up to and including the data
+// frame with the given sequence number. Payloads that are only partially
+// acknowledged keep their remaining events. Sequence numbers are compared
+// relative to the oldest pending data frame so that roll-over is handled.
+func ackPayloads(pending []*payload, sequence uint32) ([]*payload, []*FileEvent, error) {
+  var first, outstanding uint32
+  for _, p := range pending {
+    if outstanding == 0 {
+      first = p.sequence
     }
+    outstanding += p.data
+  }
+  if outstanding == 0 || sequence-first >= outstanding {
+    return pending, nil, fmt.Errorf("unexpected ack for sequence %d", sequence)
+  }
 
-    socket = tls.Client(tcpsocket, &tlsconfig)
-    socket.SetDeadline(time.Now().Add(config.timeout))
-    err = socket.Handshake()
-    if err != nil {
-      log.Printf("Failed to tls handshake with %s %s\n", address, err)
-      time.Sleep(1 * time.Second)
-      socket.Close()
-      continue
+  count := sequence - first + 1
+  var released []*FileEvent
+  // Keep going after the acked data frames to release any payloads that
+  // only carry positions
+  for len(pending) > 0 && (count > 0 || pending[0].data == 0) {
+    p := pending[0]
+    if count < p.data {
+      // Partial ack, keep the rest of the payload pending
+      acked := count
+      i := 0
+      for ; count > 0; i++ {
+        if p.events[i].Text != nil {
+          count--
+        }
+      }
+      released = append(released, p.events[:i]...)
+      p.events = p.events[i:]
+      p.data -= acked
+      p.sequence += acked
+      break
     }
+    released = append(released, p.events...)
+    count -= p.data
+    pending = pending[1:]
+    if p.data > 0 {
+      metrics.BatchPublished(time.Since(p.sent))
+    }
+  }
+  return pending, released, nil
+}
+
+// connect_server connects to one server, at one of the addresses its name
+// resolves to.
+func connect_server(config *NetworkConfig, material *TLSMaterial, hostport string) (net.Conn, error) {
+  submatch := hostport_re.FindSubmatch([]byte(hostport))
+  if submatch == nil {
+    return nil, fmt.Errorf("invalid host:port '%s'", hostport)
+  }
+  host := string(submatch[1])
+  port := string(submatch[2])
+  addresses, err := net.LookupHost(host)
+
+  if err != nil {
+    return nil, fmt.Errorf("DNS lookup failure \"%s\": %s", host, err)
+  }
+
+  address := addresses[rand.Int()%len(addresses)]
+  var addressport string
 
-    log.Printf("Connected to %s\n", address)
+  ip := net.ParseIP(address)
+  if len(ip) == net.IPv4len {
+      addressport = fmt.Sprintf("%s:%s", address, port)
+  } else if len(ip) == net.IPv6len {
+      addressport = fmt.Sprintf("[%s]:%s", address, port)
+  }
+
+  log.Printf("Connecting to %s (%s) \n", addressport, host)
+
+  tcpsocket, err := net.DialTimeout("tcp", addressport, config.timeout)
+  if err != nil {
+    return nil, fmt.Errorf("failure connecting to %s: %s", address, err)
+  }
 
-    // connected, let's rock and roll.
-    return
+  if config.Transport == transport_tcp {
+    log.Printf("WARNING: transport tcp: events sent to %s are neither encrypted nor authenticated, anyone on the network can read or forge them\n", hostport)
+    return tcpsocket, nil
   }
-  return
+
+  tlsconfig, err := load_tls_config(config, material, host)
+  if err != nil {
+    tcpsocket.Close()
+    return nil, err
+  }
+  socket := tls.Client(tcpsocket, tlsconfig)
+  socket.SetDeadline(time.Now().Add(config.timeout))
+  err = socket.Handshake()
+  if err != nil {
+    metrics.HandshakeFailed()
+    socket.Close()
+    return nil, fmt.Errorf("failed to tls handshake with %s: %s", address, err)
+  }
+  return socket, nil
 }
 
+// Keys written for every event, which fields decoded from the line can't
+// replace
+var reserved_keys = map[string]bool{"file": true, "host": true, "offset": true, "line": true, "line_number": true, "truncated": true}
+
 func writeDataFrame(event *FileEvent, sequence uint32, output io.Writer) {
   //log.Printf("event: %s\n", *event.Text)
   // header, "1D"
   output.Write([]byte("1D"))
   // sequence number
   binary.Write(output, binary.BigEndian, uint32(sequence))
+  // Fields decoded from the line, unless they clash with the keys below or
+  // the configured fields
+  var decoded []string
+  for k := range event.Decoded {
+    if _, found := (*event.Fields)[k]; !found && !reserved_keys[k] {
+      decoded = append(decoded, k)
+    }
+  }
+
   // 'pair' count
-  binary.Write(output, binary.BigEndian, uint32(len(*event.Fields)+4))
+  pairs := len(*event.Fields) + len(decoded) + 4
+  if event.Line > 0 {
+    pairs++
+  }
+  if event.Truncated {
+    pairs++
+  }
+  binary.Write(output, binary.BigEndian, uint32(pairs))
 
   writeKV("file", *event.Source, output)
   writeKV("host", hostname, output)
   writeKV("offset", strconv.FormatInt(event.Offset, 10), output)
   writeKV("line", *event.Text, output)
+  if event.Line > 0 {
+    writeKV("line_number", strconv.FormatUint(event.Line, 10), output)
+  }
+  if event.Truncated {
+    writeKV("truncated", "true", output)
+  }
+  for _, k := range decoded {
+    writeKV(k, event.Decoded[k], output)
+  }
   for k, v := range *event.Fields {
     writeKV(k, v, output)
   }
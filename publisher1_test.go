@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -10,6 +11,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"log"
+	"lumberjack"
 	"math/big"
 	"net"
 	"os"
@@ -155,10 +157,13 @@ func tryConnect(addr string, strict bool) (errchan chan error) {
 		timeout:   time.Second * wait,
 	}
 
-		var socket *tls.Conn
+		var socket net.Conn
 		for socket == nil && tryAttempt < retryLimit {
 			select {
 			case socket = <-doConnect(config):
+				if socket == nil {
+					tryAttempt++
+				}
 			case <-time.After(time.Second * wait):
 				log.Printf("INFO: Connect timeout: attempt: %d\n", tryAttempt)
 				tryAttempt++
@@ -171,7 +176,7 @@ func tryConnect(addr string, strict bool) (errchan chan error) {
 		defer socket.Close()
 		log.Printf("INFO: Connected to %s\n", socket.RemoteAddr())
 
-		if !socket.ConnectionState().HandshakeComplete {
+		if !socket.(*tls.Conn).ConnectionState().HandshakeComplete {
 			errchan <- errors.New("handshake should be complete")
 			return
 		}
@@ -180,10 +185,16 @@ func tryConnect(addr string, strict bool) (errchan chan error) {
 	return errchan
 }
 
-func doConnect(config *NetworkConfig) <-chan *tls.Conn {
-	sockchan := make(chan *tls.Conn)
+func doConnect(config *NetworkConfig) <-chan net.Conn {
+	sockchan := make(chan net.Conn)
 	go func() {
-		sockchan <- connect(config)
+		material := NewTLSMaterial(config)
+		defer material.Close()
+		socket, err := connect_server(config, material, config.Servers[0])
+		if err != nil {
+			log.Printf("INFO: Connect failed: %s\n", err)
+		}
+		sockchan <- socket
 	}()
 	return sockchan
 }
@@ -229,3 +240,234 @@ func TestStrictConnectToIpWithSAN(t *testing.T) {
 		t.Fatal("Should not have failed", err)
 	}
 }
+
+// ----------------------------------------------------------------------
+// Acknowledgements
+// ----------------------------------------------------------------------
+
+func testPayloads(sequence uint32, sizes ...int) (pending []*payload) {
+	for _, size := range sizes {
+		p := &payload{}
+		for i := 0; i < size; i++ {
+			source, text := "test.log", "line"
+			p.events = append(p.events, &FileEvent{Source: &source, Text: &text, Fields: &map[string]string{}})
+		}
+		sequence = p.encode(sequence)
+		pending = append(pending, p)
+	}
+	return
+}
+
+func TestAckPayloadsPartial(t *testing.T) {
+	pending := testPayloads(0, 3, 3)
+
+	pending, released, err := ackPayloads(pending, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 4 {
+		t.Errorf("expected 4 released events, got %d", len(released))
+	}
+	if len(pending) != 1 || len(pending[0].events) != 2 || pending[0].sequence != 5 {
+		t.Fatalf("expected the partially acked payload to remain from sequence 5")
+	}
+
+	pending, released, err = ackPayloads(pending, 6)
+	if err != nil || len(released) != 2 || len(pending) != 0 {
+		t.Errorf("expected the rest to be released: %d released, %d pending, %v", len(released), len(pending), err)
+	}
+}
+
+func TestAckPayloadsRollOver(t *testing.T) {
+	pending := testPayloads(^uint32(0)-1, 4)
+	if pending[0].sequence != ^uint32(0) {
+		t.Fatalf("unexpected first sequence %d", pending[0].sequence)
+	}
+
+	pending, released, err := ackPayloads(pending, 1)
+	if err != nil || len(released) != 3 || len(pending) != 1 {
+		t.Errorf("expected 3 events released across roll-over: %d released, %v", len(released), err)
+	}
+}
+
+func TestAckPayloadsUnexpected(t *testing.T) {
+	pending := testPayloads(10, 2)
+
+	if _, _, err := ackPayloads(pending, 10); err == nil {
+		t.Errorf("expected an ack before the window to be rejected")
+	}
+	if _, _, err := ackPayloads(pending, 13); err == nil {
+		t.Errorf("expected an ack beyond the window to be rejected")
+	}
+}
+
+// ----------------------------------------------------------------------
+// End to end
+// ----------------------------------------------------------------------
+
+func TestPublishv1ToReceiver(t *testing.T) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{makeCert("localhost")}})
+	if err != nil {
+		testBug(err)
+	}
+	defer listener.Close()
+
+	received := make(chan *lumberjack.Event, 10)
+	server := &lumberjack.Server{Handler: func(events []*lumberjack.Event) error {
+		for _, event := range events {
+			received <- event
+		}
+		return nil
+	}}
+	go server.Serve(listener)
+
+	config := &NetworkConfig{
+		Servers:            []string{listener.Addr().String()},
+		timeout:            5 * time.Second,
+		MaxPendingPayloads: 2,
+	}
+	input := make(chan []*FileEvent)
+	registrar := make(chan []*FileEvent, 10)
+	go Publishv1(input, registrar, config, nil)
+
+	source := "test.log"
+	fields := map[string]string{"type": "test"}
+	var batches [][]*FileEvent
+	for _, lines := range [][]string{{"one", "two"}, {"three"}} {
+		var events []*FileEvent
+		for i := range lines {
+			events = append(events, &FileEvent{Source: &source, Offset: int64(i), Text: &lines[i], Fields: &fields})
+		}
+		batches = append(batches, events)
+		input <- events
+	}
+
+	for _, expected := range []string{"one", "two", "three"} {
+		select {
+		case event := <-received:
+			if event.Fields["line"] != expected || event.Fields["type"] != "test" || event.Fields["file"] != source {
+				t.Errorf("unexpected event: %v", event.Fields)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", expected)
+		}
+	}
+
+	var acked int
+	for acked < 3 {
+		select {
+		case events := <-registrar:
+			acked += len(events)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for acks, %d acked", acked)
+		}
+	}
+	if acked != 3 {
+		t.Errorf("expected 3 events to be acknowledged, got %d", acked)
+	}
+}
+
+func TestPublishv1OverTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		testBug(err)
+	}
+	defer listener.Close()
+
+	received := make(chan *lumberjack.Event, 10)
+	server := &lumberjack.Server{Handler: func(events []*lumberjack.Event) error {
+		for _, event := range events {
+			received <- event
+		}
+		return nil
+	}}
+	go server.Serve(listener)
+
+	config := &NetworkConfig{
+		Servers:            []string{listener.Addr().String()},
+		Transport:          transport_tcp,
+		timeout:            5 * time.Second,
+		MaxPendingPayloads: 2,
+	}
+	input := make(chan []*FileEvent)
+	registrar := make(chan []*FileEvent, 10)
+	go Publishv1(input, registrar, config, nil)
+
+	source := "test.log"
+	line := "plain"
+	fields := map[string]string{}
+	input <- []*FileEvent{{Source: &source, Text: &line, Fields: &fields}}
+	close(input)
+
+	select {
+	case event := <-received:
+		if event.Fields["line"] != line {
+			t.Errorf("unexpected event: %v", event.Fields)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the event")
+	}
+	if events := <-registrar; len(events) != 1 {
+		t.Errorf("expected 1 event to be acknowledged, got %d", len(events))
+	}
+}
+
+func TestAckPayloadsPositions(t *testing.T) {
+	source := "test.log"
+	pending := testPayloads(0, 2)
+	// A payload with only a position is not sent, but waits for the payload
+	// before it to be acknowledged
+	position := &payload{events: []*FileEvent{{Source: &source, Offset: 100}}}
+	position.encode(2)
+	if position.data != 0 || len(position.frame) != 0 {
+		t.Fatalf("a payload of positions should have no data frames")
+	}
+	pending = append(pending, position)
+
+	pending, released, err := ackPayloads(pending, 1)
+	if err != nil || len(released) != 1 || len(pending) != 2 {
+		t.Fatalf("expected the position to wait: %d released, %d pending, %v", len(released), len(pending), err)
+	}
+
+	pending, released, err = ackPayloads(pending, 2)
+	if err != nil || len(released) != 2 || len(pending) != 0 || released[1].Offset != 100 {
+		t.Errorf("expected the position to be released after the data: %d released, %d pending, %v", len(released), len(pending), err)
+	}
+}
+
+func TestWriteDataFrameTruncated(t *testing.T) {
+	source := "test.log"
+	text := "0123456789"
+	fields := map[string]string{"type": "test"}
+
+	for _, truncated := range []bool{false, true} {
+		var buffer bytes.Buffer
+		writeDataFrame(&FileEvent{Source: &source, Text: &text, Truncated: truncated, Fields: &fields}, 1, &buffer)
+
+		frame, err := lumberjack.NewDecoder(&buffer).Decode()
+		if err != nil {
+			t.Fatalf("failed to decode data frame: %s", err)
+		}
+		if _, found := frame.Data["truncated"]; found != truncated || frame.Data["line"] != text {
+			t.Errorf("expected truncated field only when truncated (%v), got %v", truncated, frame.Data)
+		}
+	}
+}
+
+func TestWriteDataFrameDecoded(t *testing.T) {
+	source := "test.log"
+	text := "hello"
+	fields := map[string]string{"type": "test"}
+	event := &FileEvent{Source: &source, Text: &text, Fields: &fields, Line: 7,
+		Decoded: map[string]string{"level": "info", "type": "decoded", "offset": "decoded", "line_number": "decoded"}}
+
+	var buffer bytes.Buffer
+	writeDataFrame(event, 1, &buffer)
+	frame, err := lumberjack.NewDecoder(&buffer).Decode()
+	if err != nil {
+		t.Fatalf("failed to decode data frame: %s", err)
+	}
+	if frame.Data["level"] != "info" || frame.Data["type"] != "test" || frame.Data["offset"] != "0" || frame.Data["line_number"] != "7" || len(frame.Data) != 7 {
+		t.Errorf("expected decoded fields not to replace other keys, got %v", frame.Data)
+	}
+}
@@ -1,32 +1,150 @@
 package main
 
 import (
+  "encoding/json"
+  "fmt"
   "log"
+  "os"
+  "time"
 )
 
-func Registrar(state map[string]*FileState, input chan []*FileEvent) {
-  for events := range input {
-    log.Printf("Registrar received %d events\n", len(events))
-    // Take the last event found for each file source
-    for _, event := range events {
-      // skip stdin
-      if *event.Source == "-" {
-        continue
+func Registrar(state map[string]*FileState, input chan []*FileEvent, path string, clean_after time.Duration) {
+  for source, filestate := range state {
+    metrics.Acknowledged(source, filestate.Offset, filestate.Complete)
+  }
+
+  // Periodically forget files that have gone away
+  var prune <-chan time.Time
+  stale := make(map[string]time.Time)
+  if clean_after > 0 {
+    interval := time.Minute
+    if clean_after < interval {
+      interval = clean_after
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    prune = ticker.C
+  }
+
+  for {
+    select {
+    case events, ok := <-input:
+      if !ok {
+        // Input closed on shutdown, save the final state
+        save_registry(state, path)
+        return
+      }
+
+      log.Printf("Registrar received %d events\n", len(events))
+      // Take the last event found for each file source
+      for _, event := range events {
+        // skip stdin
+        if *event.Source == "-" {
+          continue
+        }
+
+        ino, dev := file_ids(event.fileinfo)
+        state[*event.Source] = &FileState{
+          Source: event.Source,
+          // take the offset + raw length of the event (including the EOL
+          // chars, whether LF or CRLF) and save it as the new starting offset.
+          Offset: event.Offset + event.RawLength,
+          Line:   event.last_line(),
+          Inode:  ino,
+          Device: dev,
+          Fingerprint: event.fingerprint,
+          Complete: event.complete,
+        }
+        metrics.Acknowledged(*event.Source, state[*event.Source].Offset, event.complete)
+        //log.Printf("State %s: %d\n", *event.Source, event.Offset)
       }
 
-      ino, dev := file_ids(event.fileinfo)
-      state[*event.Source] = &FileState{
-        Source: event.Source,
-        // take the offset + length of the line + newline char and
-        // save it as the new starting offset.
-        // This issues a problem, if the EOL is a CRLF! Then on start it read the LF again and generates a event with an empty line
-        Offset: event.Offset + int64(len(*event.Text)) + 1,
-        Inode:  ino,
-        Device: dev,
+      save_registry(state, path)
+    case now := <-prune:
+      if prune_registry(state, stale, clean_after, now) > 0 {
+        save_registry(state, path)
       }
-      //log.Printf("State %s: %d\n", *event.Source, event.Offset)
     }
+  }
+}
+
+// prune_registry forgets the state of files that have been missing, or
+// replaced by a different file, for at least clean_after. stale records when
+// each file was first seen to be gone. It returns how many were forgotten.
+func prune_registry(state map[string]*FileState, stale map[string]time.Time, clean_after time.Duration, now time.Time) (pruned int) {
+  for source, filestate := range state {
+    info, err := os.Stat(source)
+    if err == nil && is_file_same(source, info, filestate) {
+      delete(stale, source)
+      continue
+    } else if err != nil && !os.IsNotExist(err) {
+      // Can't tell, so leave it be
+      continue
+    }
+
+    since, found := stale[source]
+    if !found {
+      stale[source] = now
+      continue
+    }
+    if gone := now.Sub(since); gone >= clean_after {
+      log.Printf("Forgetting the state of %s, it has been gone for %v\n", source, gone)
+      delete(state, source)
+      delete(stale, source)
+      metrics.Forget(source)
+      pruned++
+    }
+  }
+
+  // Files forgotten some other way needn't be tracked
+  for source := range stale {
+    if _, found := state[source]; !found {
+      delete(stale, source)
+    }
+  }
+  return
+}
+
+func save_registry(state map[string]*FileState, path string) {
+  if err := WriteRegistry(state, path); err != nil {
+    log.Printf("Failed to save the registry: %s\n", err)
+    metrics.RegistryWriteFailed()
+  }
+}
+
+// LoadRegistry reads the file states saved by a previous run. It returns an
+// empty registry if there is none or it can't be read.
+func LoadRegistry(path string) map[string]*FileState {
+  files, err := read_registry(path)
+  if os.IsNotExist(err) {
+    log.Printf("No registry at %s, starting afresh\n", path)
+  } else if err != nil {
+    log.Printf("Failed to read the registry: %s\n", err)
+  } else {
+    log.Printf("Loaded the registry from %s\n", path)
+  }
+  return files
+}
+
+func read_registry(path string) (map[string]*FileState, error) {
+  history, err := os.Open(path)
+  if os.IsNotExist(err) {
+    // Windows moves the registry aside before replacing it, so it may only
+    // exist as the old copy
+    if old, old_err := os.Open(path + ".old"); old_err == nil {
+      history, err = old, nil
+      path += ".old"
+    }
+  }
+  if err != nil {
+    return make(map[string]*FileState), err
+  }
+  defer history.Close()
 
-    WriteRegistry(state, ".logstash-forwarder")
+  files := make(map[string]*FileState)
+  decoder := json.NewDecoder(history)
+  if err = decoder.Decode(&files); err != nil {
+    return make(map[string]*FileState), fmt.Errorf("failed to decode %s: %s", path, err)
   }
+  return files, nil
 }
@@ -4,21 +4,45 @@ package main
 
 import (
   "encoding/json"
-  "log"
+  "fmt"
   "os"
+  "path/filepath"
 )
 
-func WriteRegistry(state map[string]*FileState, path string) {
-  // Open tmp file, write, flush, rename
-  file, err := os.Create(".logstash-forwarder.new")
+// WriteRegistry saves the state to a temporary file, syncs it and renames it
+// over the registry, then syncs the directory so the rename is durable too.
+// A crash at any point leaves either the old or the new registry in place.
+func WriteRegistry(state map[string]*FileState, path string) error {
+  tmp := path + ".new"
+  file, err := os.Create(tmp)
   if err != nil {
-    log.Printf("Failed to open .logstash-forwarder.new for writing: %s\n", err)
-    return
+    return fmt.Errorf("failed to open %s for writing: %s", tmp, err)
   }
-  defer file.Close()
 
   encoder := json.NewEncoder(file)
-  encoder.Encode(state)
+  err = encoder.Encode(state)
+  if err == nil {
+    err = file.Sync()
+  }
+  if close_err := file.Close(); err == nil {
+    err = close_err
+  }
+  if err != nil {
+    os.Remove(tmp)
+    return fmt.Errorf("failed to write %s: %s", tmp, err)
+  }
 
-  os.Rename(".logstash-forwarder.new", path)
+  if err = os.Rename(tmp, path); err != nil {
+    return fmt.Errorf("failed to rename %s to %s: %s", tmp, path, err)
+  }
+
+  dir, err := os.Open(filepath.Dir(path))
+  if err != nil {
+    return fmt.Errorf("failed to open the registry's directory: %s", err)
+  }
+  defer dir.Close()
+  if err = dir.Sync(); err != nil {
+    return fmt.Errorf("failed to sync the registry's directory: %s", err)
+  }
+  return nil
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-registry")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry")
+
+	source := "/var/log/app.log"
+	state := map[string]*FileState{source: {Source: &source, Offset: 42}}
+	if err := WriteRegistry(state, path); err != nil {
+		t.Fatalf("WriteRegistry failed: %s", err)
+	}
+	if _, err := os.Stat(path + ".new"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be renamed away")
+	}
+
+	loaded := LoadRegistry(path)
+	if loaded[source] == nil || loaded[source].Offset != 42 {
+		t.Errorf("Expected to load the saved state, got %v", loaded)
+	}
+
+	// A registry that can't be read starts afresh rather than half loaded
+	ioutil.WriteFile(path, []byte(`{"/var/log/app.log": {"offset": 4`), 0644)
+	if loaded = LoadRegistry(path); len(loaded) != 0 {
+		t.Errorf("Expected a truncated registry to be ignored, got %v", loaded)
+	}
+
+	if err := WriteRegistry(state, filepath.Join(dir, "missing", "registry")); err == nil {
+		t.Errorf("Expected an error writing to a missing directory")
+	}
+}
+
+func TestLoadConfigRegistryFile(t *testing.T) {
+	fname := writeConfFile([]byte(`{
+  "network": { "servers": [ "localhost:5043" ] },
+  "files": [ { "paths": [ "/var/log/app.log" ] } ],
+  "registry file": "state/registry"
+}`))
+	config, e := LoadConfig(fname)
+	if e != nil {
+		t.Fatalf("filename:%s - error: %s", fname, e)
+	}
+
+	wd, _ := os.Getwd()
+	if config.RegistryFile != filepath.Join(wd, "state/registry") {
+		t.Errorf("Expected the registry file to be made absolute, got %s", config.RegistryFile)
+	}
+}
+
+func TestPruneRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-registry")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+
+	present := filepath.Join(dir, "present.log")
+	replaced := filepath.Join(dir, "replaced.log")
+	missing := filepath.Join(dir, "missing.log")
+	ioutil.WriteFile(present, nil, 0644)
+	ioutil.WriteFile(replaced, nil, 0644)
+
+	state := make(map[string]*FileState)
+	for _, source := range []string{present, replaced, missing} {
+		source := source
+		state[source] = &FileState{Source: &source}
+	}
+	info, _ := os.Stat(present)
+	state[present].Inode, state[present].Device = file_ids(&info)
+	info, _ = os.Stat(replaced)
+	ino, dev := file_ids(&info)
+	state[replaced].Inode, state[replaced].Device = ino+1, dev
+
+	stale := make(map[string]time.Time)
+	start := time.Now()
+	if pruned := prune_registry(state, stale, time.Hour, start); pruned != 0 || len(stale) != 2 {
+		t.Fatalf("Expected nothing pruned and 2 stale files at first, got %d pruned and %v", pruned, stale)
+	}
+	if pruned := prune_registry(state, stale, time.Hour, start.Add(30*time.Minute)); pruned != 0 {
+		t.Fatalf("Expected nothing pruned before clean after, got %d", pruned)
+	}
+	if pruned := prune_registry(state, stale, time.Hour, start.Add(time.Hour)); pruned != 2 {
+		t.Fatalf("Expected 2 pruned after clean after, got %d", pruned)
+	}
+	if len(state) != 1 || state[present] == nil || len(stale) != 0 {
+		t.Errorf("Expected only %s to remain, got %v (stale %v)", present, state, stale)
+	}
+}
@@ -2,23 +2,40 @@ package main
 
 import (
   "encoding/json"
-  "log"
+  "fmt"
   "os"
 )
 
-func WriteRegistry(state map[string]*FileState, path string) {
+// WriteRegistry saves the state to a temporary file and syncs it before
+// moving it into place. The previous registry is kept as path + ".old" until
+// the new one has replaced it, and LoadRegistry falls back to it.
+func WriteRegistry(state map[string]*FileState, path string) error {
   tmp := path + ".new"
   file, err := os.Create(tmp)
   if err != nil {
-    log.Printf("Failed to open .logstash-forwarder.new for writing: %s\n", err)
-    return
+    return fmt.Errorf("failed to open %s for writing: %s", tmp, err)
   }
 
   encoder := json.NewEncoder(file)
-  encoder.Encode(state)
-  file.Close()
+  err = encoder.Encode(state)
+  if err == nil {
+    err = file.Sync()
+  }
+  if close_err := file.Close(); err == nil {
+    err = close_err
+  }
+  if err != nil {
+    os.Remove(tmp)
+    return fmt.Errorf("failed to write %s: %s", tmp, err)
+  }
 
   old := path + ".old"
-  os.Rename(path, old)
-  os.Rename(tmp, path)
+  os.Remove(old)
+  if err = os.Rename(path, old); err != nil && !os.IsNotExist(err) {
+    return fmt.Errorf("failed to rename %s to %s: %s", path, old, err)
+  }
+  if err = os.Rename(tmp, path); err != nil {
+    return fmt.Errorf("failed to rename %s to %s: %s", tmp, path, err)
+  }
+  return nil
 }
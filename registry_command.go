@@ -0,0 +1,265 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "sort"
+  "text/tabwriter"
+)
+
+const registry_usage = `usage: logstash-forwarder registry [-config FILE | -registry-file FILE] COMMAND
+
+Commands:
+  list                       show each file's offset, size and lag
+  reset [-to start|end] FILE...
+                             move the offset of each file to its start or end
+  forget-missing             forget files that no longer exist
+  export [FILE]              write the registry as JSON to FILE, or stdout
+  import FILE                replace the registry with FILE, or stdin if "-"
+
+Commands that change the registry refuse to run while a forwarder is using it.
+
+Flags:
+`
+
+// RegistryCommand runs the registry subcommand with its arguments, returning
+// the exit status.
+func RegistryCommand(args []string) int {
+  flags := flag.NewFlagSet("registry", flag.ContinueOnError)
+  config_path := flags.String("config", "", "Read the registry file from this config file")
+  registry_path := flags.String("registry-file", "", "The registry file. Defaults to .logstash-forwarder in the working directory")
+  flags.Usage = func() {
+    fmt.Fprint(os.Stderr, registry_usage)
+    flags.PrintDefaults()
+  }
+  if err := flags.Parse(args); err != nil {
+    return 2
+  }
+  if flags.NArg() == 0 {
+    flags.Usage()
+    return 2
+  }
+
+  // Keep log output, such as from loading the config, off stdout
+  log.SetOutput(os.Stderr)
+  log.SetFlags(0)
+
+  path, err := find_registry(*config_path, *registry_path)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "%s\n", err)
+    return 1
+  }
+
+  command, args := flags.Arg(0), flags.Args()[1:]
+  switch command {
+  case "list":
+    err = registry_list(path, os.Stdout)
+  case "reset":
+    err = registry_reset(path, args)
+  case "forget-missing":
+    err = registry_forget_missing(path, os.Stdout)
+  case "export":
+    err = registry_export(path, args)
+  case "import":
+    err = registry_import(path, args)
+  default:
+    fmt.Fprintf(os.Stderr, "Unknown registry command '%s'\n", command)
+    flags.Usage()
+    return 2
+  }
+
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "%s\n", err)
+    return 1
+  }
+  return 0
+}
+
+func find_registry(config_path string, registry_path string) (string, error) {
+  if registry_path == "" && config_path != "" {
+    config, err := LoadConfig(config_path)
+    if err != nil {
+      return "", fmt.Errorf("failed to load %s: %s", config_path, err)
+    }
+    return config.RegistryFile, nil
+  }
+
+  if registry_path == "" {
+    registry_path = default_RegistryFile
+  }
+  return filepath.Abs(registry_path)
+}
+
+// edit_registry changes the registry while holding its lock, so it can't
+// race with a running forwarder.
+func edit_registry(path string, edit func(state map[string]*FileState) error) error {
+  lock, err := LockRegistry(path)
+  if err != nil {
+    return err
+  }
+  defer lock.Close()
+
+  state, err := read_registry(path)
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  if err = edit(state); err != nil {
+    return err
+  }
+  return WriteRegistry(state, path)
+}
+
+func registry_list(path string, output io.Writer) error {
+  state, err := read_registry(path)
+  if err != nil {
+    return err
+  }
+
+  writer := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+  fmt.Fprintf(writer, "FILE\tOFFSET\tSIZE\tLAG\tSTATUS\n")
+  for _, file := range sorted_sources(state) {
+    filestate := state[file]
+    info, err := os.Stat(file)
+    switch {
+    case err != nil:
+      fmt.Fprintf(writer, "%s\t%d\t-\t-\tmissing\n", file, filestate.Offset)
+    case !is_file_same(file, info, filestate) || !is_fingerprint_same(file, filestate):
+      fmt.Fprintf(writer, "%s\t%d\t%d\t-\treplaced\n", file, filestate.Offset, info.Size())
+    case filestate.Complete:
+      fmt.Fprintf(writer, "%s\t%d\t%d\t0\tcomplete\n", file, filestate.Offset, info.Size())
+    case is_compressed(file):
+      // Offsets in compressed files are of their decompressed content, so
+      // can't be compared with the size until the file is complete
+      fmt.Fprintf(writer, "%s\t%d\t%d\t-\treading\n", file, filestate.Offset, info.Size())
+    case info.Size() < filestate.Offset:
+      fmt.Fprintf(writer, "%s\t%d\t%d\t-\ttruncated\n", file, filestate.Offset, info.Size())
+    default:
+      fmt.Fprintf(writer, "%s\t%d\t%d\t%d\tok\n", file, filestate.Offset, info.Size(), info.Size()-filestate.Offset)
+    }
+  }
+  return writer.Flush()
+}
+
+func registry_reset(path string, args []string) error {
+  flags := flag.NewFlagSet("reset", flag.ContinueOnError)
+  to := flags.String("to", "start", "Where to move the offset to, 'start' or 'end' of the file")
+  if err := flags.Parse(args); err != nil {
+    return err
+  }
+  if *to != "start" && *to != "end" {
+    return fmt.Errorf("-to must be 'start' or 'end', not '%s'", *to)
+  }
+  if flags.NArg() == 0 {
+    return errors.New("no files given to reset")
+  }
+
+  return edit_registry(path, func(state map[string]*FileState) error {
+    for _, file := range flags.Args() {
+      file, err := filepath.Abs(file)
+      if err != nil {
+        return err
+      }
+      info, err := os.Stat(file)
+      if err != nil {
+        return err
+      }
+
+      // Take the identity of the file as it is now, in case it has rotated
+      ino, dev := file_ids(&info)
+      filestate := &FileState{Source: &file, Inode: ino, Device: dev}
+      if *to == "end" {
+        filestate.Offset = info.Size()
+      }
+      state[file] = filestate
+    }
+    return nil
+  })
+}
+
+func registry_forget_missing(path string, output io.Writer) error {
+  return edit_registry(path, func(state map[string]*FileState) error {
+    for _, file := range sorted_sources(state) {
+      if _, err := os.Stat(file); os.IsNotExist(err) {
+        fmt.Fprintf(output, "Forgetting %s\n", file)
+        delete(state, file)
+      }
+    }
+    return nil
+  })
+}
+
+func registry_export(path string, args []string) error {
+  if len(args) > 1 {
+    return errors.New("export takes at most one file")
+  }
+  state, err := read_registry(path)
+  if err != nil {
+    return err
+  }
+
+  data, err := json.MarshalIndent(state, "", "  ")
+  if err != nil {
+    return err
+  }
+  data = append(data, '\n')
+  if len(args) == 0 || args[0] == "-" {
+    _, err = os.Stdout.Write(data)
+    return err
+  }
+  return ioutil.WriteFile(args[0], data, 0644)
+}
+
+func registry_import(path string, args []string) error {
+  if len(args) != 1 {
+    return errors.New("import takes one file")
+  }
+
+  var data []byte
+  var err error
+  if args[0] == "-" {
+    data, err = ioutil.ReadAll(os.Stdin)
+  } else {
+    data, err = ioutil.ReadFile(args[0])
+  }
+  if err != nil {
+    return err
+  }
+
+  imported := make(map[string]*FileState)
+  if err = json.Unmarshal(data, &imported); err != nil {
+    return fmt.Errorf("failed to decode %s: %s", args[0], err)
+  }
+  for file, filestate := range imported {
+    if filestate == nil {
+      return fmt.Errorf("no state for %s in %s", file, args[0])
+    }
+    file := file
+    filestate.Source = &file
+  }
+
+  return edit_registry(path, func(state map[string]*FileState) error {
+    for file := range state {
+      delete(state, file)
+    }
+    for file, filestate := range imported {
+      state[file] = filestate
+    }
+    return nil
+  })
+}
+
+func sorted_sources(state map[string]*FileState) []string {
+  files := make([]string, 0, len(state))
+  for file := range state {
+    files = append(files, file)
+  }
+  sort.Strings(files)
+  return files
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistryCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-registry")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry")
+	present := filepath.Join(dir, "present.log")
+	missing := filepath.Join(dir, "missing.log")
+	ioutil.WriteFile(present, []byte("0123456789"), 0644)
+
+	if err := registry_reset(path, []string{"-to", "end", present}); err != nil {
+		t.Fatalf("reset failed: %s", err)
+	}
+	state, _ := read_registry(path)
+	if state[present] == nil || state[present].Offset != 10 {
+		t.Fatalf("Expected %s to be reset to its end, got %v", present, state[present])
+	}
+
+	if err := registry_reset(path, []string{"-to", "middle", present}); err == nil {
+		t.Errorf("Expected an error for an unknown reset position")
+	}
+
+	export := filepath.Join(dir, "export.json")
+	ioutil.WriteFile(export, []byte(`{"`+missing+`": {"offset": 5}, "`+present+`": {"offset": 3}}`), 0644)
+	if err := registry_import(path, []string{export}); err != nil {
+		t.Fatalf("import failed: %s", err)
+	}
+
+	var output bytes.Buffer
+	if err := registry_list(path, &output); err != nil {
+		t.Fatalf("list failed: %s", err)
+	}
+	if !strings.Contains(output.String(), missing) || !strings.Contains(output.String(), "missing") {
+		t.Errorf("Expected %s to be listed as missing:\n%s", missing, output.String())
+	}
+
+	output.Reset()
+	if err := registry_forget_missing(path, &output); err != nil {
+		t.Fatalf("forget-missing failed: %s", err)
+	}
+	state, _ = read_registry(path)
+	if len(state) != 1 || state[present] == nil || state[present].Offset != 3 || *state[present].Source != present {
+		t.Errorf("Expected only %s at offset 3 to remain, got %v", present, state)
+	}
+}
@@ -0,0 +1,44 @@
+// +build !windows
+
+package main
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "strings"
+  "syscall"
+)
+
+// LockRegistry takes an exclusive lock on the registry, so only one process
+// writes to it at a time. The lock is released when the returned file is
+// closed, or when the process exits.
+func LockRegistry(path string) (*os.File, error) {
+  lock_path := path + ".lock"
+  file, err := os.OpenFile(lock_path, os.O_RDWR|os.O_CREATE, 0644)
+  if err != nil {
+    return nil, fmt.Errorf("failed to open %s: %s", lock_path, err)
+  }
+
+  lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0}
+  if err = syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock); err != nil {
+    file.Close()
+    if err == syscall.EAGAIN || err == syscall.EACCES {
+      return nil, registry_locked_error(path, lock_path)
+    }
+    return nil, fmt.Errorf("failed to lock %s: %s", lock_path, err)
+  }
+
+  // Record who holds the lock, for the error above
+  file.Truncate(0)
+  fmt.Fprintf(file, "%d\n", os.Getpid())
+  return file, nil
+}
+
+func registry_locked_error(path string, lock_path string) error {
+  pid, _ := ioutil.ReadFile(lock_path)
+  if owner := strings.TrimSpace(string(pid)); owner != "" {
+    return fmt.Errorf("the registry %s is in use by process %s", path, owner)
+  }
+  return fmt.Errorf("the registry %s is in use by another process", path)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "syscall"
+)
+
+// Not defined by the syscall package
+const error_sharing_violation syscall.Errno = 32
+
+// LockRegistry takes an exclusive lock on the registry, so only one process
+// writes to it at a time. The lock file is opened without sharing, so no
+// other process can open it until the returned file is closed or the process
+// exits.
+func LockRegistry(path string) (*os.File, error) {
+  lock_path := path + ".lock"
+  name, err := syscall.UTF16PtrFromString(lock_path)
+  if err != nil {
+    return nil, err
+  }
+
+  handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+    syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+  if err == error_sharing_violation {
+    return nil, fmt.Errorf("the registry %s is in use by another process", path)
+  } else if err != nil {
+    return nil, fmt.Errorf("failed to lock %s: %s", lock_path, err)
+  }
+  return os.NewFile(uintptr(handle), lock_path), nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+  "encoding/json"
+  "log"
+  "reflect"
+  "strings"
+)
+
+// Reload applies a new configuration. Prospectors are started and stopped
+// to match the new file configurations, leaving the harvesters of unchanged
+// configurations running, and each output's publisher is given its new
+// network configuration. Outputs can't be added or removed. It returns the
+// configuration now in effect.
+func Reload(path string, config Config, prospectors map[string]*Prospector,
+  outputs map[string]*Output) Config {
+  log.Printf("Reloading configuration from %s\n", path)
+  newconfig, err := LoadConfig(path)
+  if err != nil {
+    log.Printf("Keeping the current configuration, reload failed: %s\n", err)
+    return config
+  }
+  if len(newconfig.Files) == 0 {
+    log.Printf("Keeping the current configuration, the new one has no paths\n")
+    return config
+  }
+  networks := newconfig.output_configs()
+  if !same_outputs(networks, outputs) {
+    log.Printf("Keeping the current configuration, outputs can't be added or removed until restarted\n")
+    return config
+  }
+  if newconfig.RegistryFile != config.RegistryFile {
+    log.Printf("The registry file can't be changed by a reload, still using %s until restarted\n", config.RegistryFile)
+    newconfig.RegistryFile = config.RegistryFile
+  }
+
+  current := make(map[string]FileConfig)
+  for _, fileconfig := range config.Files {
+    current[file_config_id(&fileconfig)] = fileconfig
+  }
+
+  started, stopped := 0, 0
+  seen := make(map[string]bool)
+  for _, fileconfig := range newconfig.Files {
+    id := file_config_id(&fileconfig)
+    seen[id] = true
+
+    resume := &ProspectorResume{persist: make(chan *FileState)}
+    if previous, found := current[id]; !found {
+      // New paths resume from whatever the registrar last saved
+      log.Printf("Starting prospector for new paths: %v\n", fileconfig.Paths)
+      resume.files = LoadRegistry(config.RegistryFile)
+    } else if !file_config_equal(&previous, &fileconfig) {
+      // Changed settings, restart the harvesters where they left off
+      log.Printf("Restarting prospector for changed paths: %v\n", fileconfig.Paths)
+      resume.files = prospectors[id].Stop()
+      stopped++
+    } else {
+      continue
+    }
+
+    prospector := NewProspector(fileconfig)
+    prospectors[id] = prospector
+    go prospector.Prospect(resume, outputs[fileconfig.Output].Events)
+    go drain_persist(resume.persist)
+    started++
+  }
+
+  for id, fileconfig := range current {
+    if !seen[id] {
+      log.Printf("Stopping prospector for removed paths: %v\n", fileconfig.Paths)
+      prospectors[id].Stop()
+      delete(prospectors, id)
+      stopped++
+    }
+  }
+
+  for name, network := range networks {
+    outputs[name].network <- network
+  }
+
+  log.Printf("Configuration reloaded, %d prospectors started and %d stopped\n", started, stopped)
+  return newconfig
+}
+
+func same_outputs(networks map[string]*NetworkConfig, outputs map[string]*Output) bool {
+  if len(networks) != len(outputs) {
+    return false
+  }
+  for name := range networks {
+    if _, found := outputs[name]; !found {
+      return false
+    }
+  }
+  return true
+}
+
+// The registrar already holds the state of files that are being harvested,
+// so states resumed after a reload don't need to be passed on.
+func drain_persist(persist chan *FileState) {
+  for state := range persist {
+    if state.Source == nil {
+      return
+    }
+  }
+}
+
+// A file configuration is identified by its paths, which LoadConfig makes
+// sure no two configurations share. If any other setting changes the
+// configuration is considered changed rather than replaced.
+func file_config_id(fileconfig *FileConfig) string {
+  return strings.Join(fileconfig.Paths, "\x00")
+}
+
+func file_config_equal(a *FileConfig, b *FileConfig) bool {
+  ja, _ := json.Marshal(a)
+  jb, _ := json.Marshal(b)
+  return reflect.DeepEqual(ja, jb)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileConfigIdentity(t *testing.T) {
+	a := FileConfig{Paths: []string{"/var/log/*.log"}, Fields: map[string]string{"type": "syslog"}}
+	b := FileConfig{Paths: []string{"/var/log/*.log"}, Fields: map[string]string{"type": "other"}}
+
+	if file_config_id(&a) != file_config_id(&b) {
+		t.Errorf("configurations with the same paths should have the same id")
+	}
+	if file_config_equal(&a, &b) {
+		t.Errorf("configurations with different fields should not be equal")
+	}
+	b.Fields["type"] = "syslog"
+	if !file_config_equal(&a, &b) {
+		t.Errorf("identical configurations should be equal")
+	}
+}
+
+func TestProspectorStopReturnsOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-prospector")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.log")
+	if err = ioutil.WriteFile(path, []byte("one\ntwo\n"), 0644); err != nil {
+		testBug(err)
+	}
+
+	resume := &ProspectorResume{files: map[string]*FileState{}, persist: make(chan *FileState)}
+	go drain_persist(resume.persist)
+
+	output := make(chan *FileEvent, 10)
+	prospector := NewProspector(FileConfig{Paths: []string{filepath.Join(dir, "*.log")}, deadtime: time.Hour})
+	go prospector.Prospect(resume, output)
+
+	// The harvester starts at the end of the file, so only lines appended
+	// after it has started are shipped
+	time.Sleep(100 * time.Millisecond)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		testBug(err)
+	}
+	file.WriteString("three\n")
+	file.Close()
+
+	select {
+	case event := <-output:
+		if *event.Text != "three" || event.Offset != 8 {
+			t.Errorf("unexpected event %q at %d", *event.Text, event.Offset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+
+	states := prospector.Stop()
+	state, found := states[path]
+	if !found {
+		t.Fatalf("expected a state for %s, got %v", path, states)
+	}
+	if state.Offset != 14 {
+		t.Errorf("expected the harvester to stop at offset 14, got %d", state.Offset)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+  "math/rand"
+  "time"
+)
+
+// The ways of choosing servers to send to
+const (
+  strategy_random      = "random"      /* one connection, to a server picked at random */
+  strategy_failover    = "failover"    /* one connection, to the first server that is up */
+  strategy_round_robin = "round-robin" /* a connection to every server, batches sent to each in turn */
+  strategy_parallel    = "parallel"    /* a connection to every server, batches sent to the least busy */
+)
+
+var strategies = map[string]bool{
+  strategy_random:      true,
+  strategy_failover:    true,
+  strategy_round_robin: true,
+  strategy_parallel:    true,
+}
+
+// A server from the servers list.
+type server struct {
+  hostport string
+  index int /* position in the servers list, the first is preferred by failover */
+  backoff *Backoff
+  held_until time.Time /* not tried again before this, after a failure */
+}
+
+// A ServerPool chooses which servers to connect to, following a strategy,
+// and holds back servers that failed.
+type ServerPool struct {
+  strategy string
+  servers []*server
+  last *connection /* connection last sent on, for round-robin */
+}
+
+func NewServerPool(config *NetworkConfig) *ServerPool {
+  pool := &ServerPool{strategy: config.Strategy}
+  if pool.strategy == "" {
+    pool.strategy = strategy_random
+  }
+  for i, hostport := range config.Servers {
+    pool.servers = append(pool.servers, &server{
+      hostport: hostport,
+      index: i,
+      backoff: NewBackoff(hostport, config.BackoffConfig),
+    })
+  }
+  return pool
+}
+
+// connections returns how many servers the strategy sends to at once.
+func (p *ServerPool) connections() int {
+  switch p.strategy {
+  case strategy_round_robin, strategy_parallel:
+    return len(p.servers)
+  }
+  return 1
+}
+
+// choose returns a server to connect to that isn't held back or in use, or
+// nil if there is none.
+func (p *ServerPool) choose(in_use map[*server]bool, now time.Time) *server {
+  var available []*server
+  for _, server := range p.servers {
+    if !in_use[server] && !now.Before(server.held_until) {
+      available = append(available, server)
+    }
+  }
+  if len(available) == 0 {
+    return nil
+  }
+  if p.strategy == strategy_random {
+    return available[rand.Intn(len(available))]
+  }
+  // Otherwise in order, so failover prefers the first
+  return available[0]
+}
+
+// next_retry returns when the next server that is held back and not in use
+// may be tried again, or the zero time if there is none.
+func (p *ServerPool) next_retry(in_use map[*server]bool) time.Time {
+  var next time.Time
+  for _, server := range p.servers {
+    if !in_use[server] && !server.held_until.IsZero() && (next.IsZero() || server.held_until.Before(next)) {
+      next = server.held_until
+    }
+  }
+  return next
+}
+
+// failed holds a server back, for longer each time it fails in a row.
+func (p *ServerPool) failed(server *server, now time.Time) time.Duration {
+  hold := server.backoff.Failed()
+  server.held_until = now.Add(hold)
+  return hold
+}
+
+// succeeded clears a server's failures, once it has acknowledged events.
+func (p *ServerPool) succeeded(server *server) {
+  server.backoff.Reset()
+  server.held_until = time.Time{}
+}
+
+// has_room reports whether any connection can take another payload.
+func has_room(connections []*connection, max_pending int) bool {
+  for _, c := range connections {
+    if c.has_room(max_pending) {
+      return true
+    }
+  }
+  return false
+}
+
+func (c *connection) has_room(max_pending int) bool {
+  return !c.retiring && len(c.pending) < max_pending
+}
+
+// pick returns the connection to send the next payload on, among those with
+// room for it, or nil if none has room. Round-robin only moves on once sent
+// is told a payload went out.
+func (p *ServerPool) pick(connections []*connection, max_pending int) *connection {
+  if p.strategy == strategy_round_robin {
+    // The first with room after the one last sent on
+    start := 0
+    for i, c := range connections {
+      if c == p.last {
+        start = i + 1
+      }
+    }
+    for i := range connections {
+      if c := connections[(start+i)%len(connections)]; c.has_room(max_pending) {
+        return c
+      }
+    }
+    return nil
+  }
+
+  var ready []*connection
+  for _, c := range connections {
+    if c.has_room(max_pending) {
+      ready = append(ready, c)
+    }
+  }
+  if len(ready) == 0 {
+    return nil
+  }
+
+  switch p.strategy {
+  case strategy_parallel:
+    least := ready[0]
+    for _, c := range ready[1:] {
+      if len(c.pending) < len(least.pending) {
+        least = c
+      }
+    }
+    return least
+  }
+  return ready[0]
+}
+
+// sent records that a payload was sent on a connection.
+func (p *ServerPool) sent(c *connection) {
+  p.last = c
+}
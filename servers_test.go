@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/tls"
+	"lumberjack"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServerPoolFailover(t *testing.T) {
+	pool := NewServerPool(&NetworkConfig{Servers: []string{"primary:5043", "secondary:5043"}, Strategy: strategy_failover})
+	now := time.Now()
+	primary := pool.choose(nil, now)
+	if primary == nil || primary.hostport != "primary:5043" {
+		t.Fatalf("Expected failover to choose the primary first, got %+v", primary)
+	}
+
+	// A failed server is held back
+	hold := pool.failed(primary, now)
+	if secondary := pool.choose(nil, now); secondary == nil || secondary.hostport != "secondary:5043" {
+		t.Fatalf("Expected failover to the secondary, got %+v", secondary)
+	}
+	if next := pool.next_retry(nil); !next.Equal(now.Add(hold)) {
+		t.Errorf("Expected the primary to be retried after %v, got %v", hold, next.Sub(now))
+	}
+
+	// Back to the primary once it's no longer held back
+	if chosen := pool.choose(nil, now.Add(hold)); chosen != primary {
+		t.Fatalf("Expected to return to the primary, got %+v", chosen)
+	}
+	pool.failed(primary, now)
+	pool.succeeded(primary)
+	if chosen := pool.choose(nil, now); chosen != primary || primary.backoff.Failures() != 0 {
+		t.Fatalf("Expected the primary once it succeeded, got %+v", chosen)
+	}
+
+	// Servers in use aren't chosen again
+	in_use := map[*server]bool{pool.servers[0]: true, pool.servers[1]: true}
+	if chosen := pool.choose(in_use, now); chosen != nil {
+		t.Fatalf("Expected no server while every one is in use, got %+v", chosen)
+	}
+}
+
+func TestServerPoolPick(t *testing.T) {
+	a, b, c := &connection{}, &connection{}, &connection{}
+	connections := []*connection{a, b, c}
+
+	pool := NewServerPool(&NetworkConfig{Strategy: strategy_round_robin})
+	var picked []*connection
+	for i := 0; i < 4; i++ {
+		c := pool.pick(connections, 2)
+		if again := pool.pick(connections, 2); again != c {
+			t.Fatalf("Expected round-robin to stay on a connection until it is sent on")
+		}
+		pool.sent(c)
+		picked = append(picked, c)
+	}
+	if picked[0] == picked[1] || picked[1] == picked[2] || picked[0] == picked[2] || picked[3] != picked[0] {
+		t.Errorf("Expected round-robin to take each connection in turn, got %v", picked)
+	}
+
+	pool = NewServerPool(&NetworkConfig{Strategy: strategy_parallel})
+	a.pending = testPayloads(0, 1, 1)
+	b.pending = testPayloads(0, 1)
+	c.pending = testPayloads(0, 1, 1)
+	if chosen := pool.pick(connections, 2); chosen != b {
+		t.Errorf("Expected parallel to pick the least busy connection")
+	}
+
+	// Connections that are full or retiring aren't sent to
+	b.retiring = true
+	if chosen := pool.pick(connections, 2); chosen != nil {
+		t.Errorf("Expected no connection with room, got %+v", chosen)
+	}
+}
+
+func TestReleaseOrder(t *testing.T) {
+	source := "test.log"
+	var events []*FileEvent
+	for i := 0; i < 4; i++ {
+		events = append(events, &FileEvent{Source: &source, Offset: int64(i)})
+	}
+	order := new_release_order()
+	order.add(events[:2])
+	order.add(events[2:])
+
+	// The later batch is acknowledged first, so waits for the earlier one
+	if released := order.ack(events[2:]); len(released) != 0 {
+		t.Fatalf("Expected nothing released before the first batch, got %d events", len(released))
+	}
+	if released := order.ack(events[:1]); len(released) != 1 || released[0] != events[0] {
+		t.Fatalf("Expected the first event released, got %v", released)
+	}
+	released := order.ack(events[1:2])
+	if len(released) != 3 {
+		t.Fatalf("Expected the remaining 3 events released, got %d", len(released))
+	}
+	for i, event := range released {
+		if event != events[i+1] {
+			t.Errorf("Expected event %d released in order, got offset %d", i+1, event.Offset)
+		}
+	}
+}
+
+func TestPublishv1Parallel(t *testing.T) {
+	received := make(chan *lumberjack.Event, 20)
+	var servers []string
+	for i := 0; i < 2; i++ {
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{makeCert("localhost")}})
+		if err != nil {
+			testBug(err)
+		}
+		defer listener.Close()
+		server := &lumberjack.Server{Handler: func(events []*lumberjack.Event) error {
+			for _, event := range events {
+				received <- event
+			}
+			return nil
+		}}
+		go server.Serve(listener)
+		servers = append(servers, listener.Addr().String())
+	}
+
+	config := &NetworkConfig{
+		Servers:            servers,
+		timeout:            5 * time.Second,
+		MaxPendingPayloads: 1,
+		Strategy:           strategy_parallel,
+	}
+	input := make(chan []*FileEvent)
+	registrar := make(chan []*FileEvent, 10)
+	go Publishv1(input, registrar, config, nil)
+
+	source := "test.log"
+	fields := map[string]string{"type": "test"}
+	for i := 0; i < 6; i++ {
+		text := strconv.Itoa(i)
+		input <- []*FileEvent{{Source: &source, Offset: int64(i), Text: &text, Fields: &fields}}
+	}
+	close(input)
+
+	// Acknowledged in the order published, whichever server had them
+	var offset int64
+	for events := range registrar {
+		for _, event := range events {
+			if event.Offset != offset {
+				t.Fatalf("Expected offset %d to be acknowledged next, got %d", offset, event.Offset)
+			}
+			offset++
+		}
+	}
+	if offset != 6 || len(received) != 6 {
+		t.Errorf("Expected 6 events sent and acknowledged, got %d received and %d acknowledged", len(received), offset)
+	}
+}
+
+func TestPublishv1RoundRobin(t *testing.T) {
+	type delivery struct {
+		server int
+		text   string
+	}
+	received := make(chan delivery, 20)
+	var servers []string
+	for i := 0; i < 2; i++ {
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{makeCert("localhost")}})
+		if err != nil {
+			testBug(err)
+		}
+		defer listener.Close()
+		index := i
+		server := &lumberjack.Server{Handler: func(events []*lumberjack.Event) error {
+			for _, event := range events {
+				received <- delivery{index, event.Fields["line"]}
+			}
+			return nil
+		}}
+		go server.Serve(listener)
+		servers = append(servers, listener.Addr().String())
+	}
+
+	config := &NetworkConfig{
+		Servers:            servers,
+		timeout:            5 * time.Second,
+		MaxPendingPayloads: 10,
+		Strategy:           strategy_round_robin,
+	}
+	input := make(chan []*FileEvent)
+	registrar := make(chan []*FileEvent, 10)
+	go Publishv1(input, registrar, config, nil)
+
+	// Wait for both connections, so every batch has a choice of two
+	connected := func() bool {
+		count := 0
+		for _, server := range metrics.Status().Servers["network"] {
+			if server == servers[0] || server == servers[1] {
+				count++
+			}
+		}
+		return count == 2
+	}
+	for start := time.Now(); !connected(); {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Timed out connecting to both servers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	source := "test.log"
+	fields := map[string]string{"type": "test"}
+	for i := 0; i < 8; i++ {
+		text := strconv.Itoa(i)
+		input <- []*FileEvent{{Source: &source, Offset: int64(i), Text: &text, Fields: &fields}}
+	}
+	close(input)
+	for range registrar {
+	}
+
+	// Batches alternate, so each server gets every other one
+	servers_of := make(map[int]map[int]bool)
+	for i := 0; i < 8; i++ {
+		d := <-received
+		n, _ := strconv.Atoi(d.text)
+		if servers_of[n%2] == nil {
+			servers_of[n%2] = make(map[int]bool)
+		}
+		servers_of[n%2][d.server] = true
+	}
+	if len(servers_of[0]) != 1 || len(servers_of[1]) != 1 {
+		t.Fatalf("Expected even and odd batches to each go to one server, got %v", servers_of)
+	}
+	for server := range servers_of[0] {
+		if servers_of[1][server] {
+			t.Errorf("Expected batches to alternate between the servers, all went to server %d", server)
+		}
+	}
+}
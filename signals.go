@@ -0,0 +1,47 @@
+package main
+
+import (
+  "log"
+  "os"
+  "os/signal"
+  "syscall"
+  "time"
+)
+
+// HandleSignals reloads the configuration on SIGHUP. On SIGINT or SIGTERM it
+// stops every prospector and harvester, then sends a nil event to tell the
+// spooler of each output to flush what it holds so the rest of the pipeline
+// drains. It returns a channel that fires once the pipeline has had timeout
+// to drain.
+func HandleSignals(path string, config Config, prospectors map[string]*Prospector,
+  outputs map[string]*Output, timeout time.Duration) <-chan time.Time {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+
+  for {
+    sig := <-signals
+    if sig == syscall.SIGHUP {
+      config = Reload(path, config, prospectors, outputs)
+      continue
+    }
+
+    log.Printf("Received %s, shutting down\n", sig)
+    signal.Stop(signals)
+
+    // Start the clock before telling the spoolers anything, as a spooler can
+    // be stuck behind a publisher that can't reach its server
+    deadline := time.After(timeout)
+
+    for _, prospector := range prospectors {
+      prospector.Stop()
+    }
+    // No harvesters are left to write to the spoolers, except perhaps one
+    // blocked reading stdin, which stops instead of sending anything else
+    go func() {
+      for _, output := range outputs {
+        output.Events <- nil
+      }
+    }()
+    return deadline
+  }
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The shutdown test runs the forwarder in a copy of the test binary, so it
+// can check how the process exits.
+func TestMain(m *testing.M) {
+	if os.Getenv("LOGSTASH_FORWARDER_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestShutdownTimeoutWithServerDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-shutdown")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An address nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		testBug(err)
+	}
+	server := listener.Addr().String()
+	listener.Close()
+
+	// Enough lines to fill the spooler and its channels while the publisher
+	// can't send them anywhere
+	log_file := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(log_file, []byte(strings.Repeat("a line\n", 200)), 0644); err != nil {
+		testBug(err)
+	}
+	config_file := filepath.Join(dir, "forwarder.conf")
+	config := `{ "network": { "servers": [ "` + server + `" ], "transport": "tcp" }, "files": [ { "paths": [ "` + log_file + `" ] } ] }`
+	if err := ioutil.WriteFile(config_file, []byte(config), 0644); err != nil {
+		testBug(err)
+	}
+
+	cmd := exec.Command(os.Args[0],
+		"-config", config_file,
+		"-registry-file", filepath.Join(dir, "registry"),
+		"-from-beginning",
+		"-spool-size", "1",
+		"-shutdown-timeout", "1s")
+	cmd.Env = append(os.Environ(), "LOGSTASH_FORWARDER_MAIN=1")
+	if err := cmd.Start(); err != nil {
+		testBug(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	time.Sleep(1 * time.Second)
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	select {
+	case err := <-exited:
+		exit, ok := err.(*exec.ExitError)
+		if !ok || exit.ExitCode() != exit_shutdown_timeout {
+			t.Errorf("Expected exit status %d, got %v", exit_shutdown_timeout, err)
+		}
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("Expected the forwarder to exit once the shutdown timeout passed")
+	}
+}
@@ -25,6 +25,20 @@ func Spool(input chan *FileEvent,
   for {
     select {
     case event := <-input:
+      if event == nil {
+        // Shutting down. Flush what we have, if anything, and let the
+        // publisher finish
+        if spool_i > 0 {
+          var spoolcopy []*FileEvent
+          spoolcopy = append(spoolcopy, spool[0:spool_i]...)
+          output <- spoolcopy
+          metrics.EventsSpooled(len(spoolcopy))
+        }
+        ticker.Stop()
+        close(output)
+        return
+      }
+
       //append(spool, event)
       spool[spool_i] = event
       spool_i++
@@ -36,6 +50,7 @@ func Spool(input chan *FileEvent,
         //fmt.Println(spool[0])
         spoolcopy = append(spoolcopy, spool[:]...)
         output <- spoolcopy
+        metrics.EventsSpooled(len(spoolcopy))
         next_flush_time = time.Now().Add(idle_timeout)
 
         spool_i = 0
@@ -52,6 +67,7 @@ func Spool(input chan *FileEvent,
           var spoolcopy []*FileEvent
           spoolcopy = append(spoolcopy, spool[0:spool_i]...)
           output <- spoolcopy
+          metrics.EventsSpooled(len(spoolcopy))
           next_flush_time = now.Add(idle_timeout)
           spool_i = 0
         }
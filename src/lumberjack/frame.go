@@ -0,0 +1,175 @@
+// Package lumberjack decodes the lumberjack v1 wire format described in
+// PROTOCOL.md and provides a small server that acknowledges what it reads.
+package lumberjack
+
+import (
+  "bytes"
+  "compress/zlib"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "io/ioutil"
+)
+
+const Version byte = '1'
+
+// Frame types
+const (
+  FrameData       byte = 'D'
+  FrameAck        byte = 'A'
+  FrameWindowSize byte = 'W'
+  FrameCompressed byte = 'C'
+)
+
+// Sanity limit on the size of any single length-prefixed field, so a corrupt
+// or hostile stream can't make us allocate without bound.
+const MaxFieldSize uint32 = 64 << 20
+
+// A Frame is a single decoded frame. Which fields are set depends on Type:
+// Sequence and Data for data frames, Sequence for acks, Window for window
+// size frames and Frames, the decompressed frames, for compressed frames.
+type Frame struct {
+  Type     byte
+  Sequence uint32
+  Window   uint32
+  Data     map[string]string
+  Frames   []*Frame
+}
+
+type Decoder struct {
+  reader io.Reader
+}
+
+func NewDecoder(reader io.Reader) *Decoder {
+  return &Decoder{reader: reader}
+}
+
+// Decode reads the next frame. It returns io.EOF if the stream ends cleanly
+// between frames.
+func (d *Decoder) Decode() (*Frame, error) {
+  var header [2]byte
+  if _, err := io.ReadFull(d.reader, header[:]); err != nil {
+    return nil, err
+  }
+  if header[0] != Version {
+    return nil, fmt.Errorf("unsupported protocol version %q", header[0])
+  }
+
+  frame := &Frame{Type: header[1]}
+  var err error
+  switch frame.Type {
+  case FrameData:
+    err = d.decodeData(frame)
+  case FrameAck:
+    frame.Sequence, err = d.readUint32()
+  case FrameWindowSize:
+    frame.Window, err = d.readUint32()
+  case FrameCompressed:
+    err = d.decodeCompressed(frame)
+  default:
+    return nil, fmt.Errorf("unknown frame type %q", frame.Type)
+  }
+
+  if err == io.EOF {
+    err = io.ErrUnexpectedEOF
+  }
+  if err != nil {
+    return nil, err
+  }
+  return frame, nil
+}
+
+func (d *Decoder) decodeData(frame *Frame) (err error) {
+  if frame.Sequence, err = d.readUint32(); err != nil {
+    return
+  }
+  count, err := d.readUint32()
+  if err != nil {
+    return
+  }
+
+  frame.Data = make(map[string]string)
+  for i := uint32(0); i < count; i++ {
+    key, err := d.readString()
+    if err != nil {
+      return err
+    }
+    value, err := d.readString()
+    if err != nil {
+      return err
+    }
+    frame.Data[key] = value
+  }
+  return nil
+}
+
+func (d *Decoder) decodeCompressed(frame *Frame) error {
+  length, err := d.readUint32()
+  if err != nil {
+    return err
+  }
+  if length > MaxFieldSize {
+    return fmt.Errorf("compressed frame of %d bytes is too large", length)
+  }
+
+  compressed := make([]byte, length)
+  if _, err = io.ReadFull(d.reader, compressed); err != nil {
+    return err
+  }
+
+  decompressor, err := zlib.NewReader(bytes.NewReader(compressed))
+  if err != nil {
+    return fmt.Errorf("invalid compressed frame: %s", err)
+  }
+  // Bound the decompressed size too, as a small frame can expand enormously
+  payload, err := ioutil.ReadAll(io.LimitReader(decompressor, int64(MaxFieldSize)+1))
+  decompressor.Close()
+  if err != nil {
+    return fmt.Errorf("invalid compressed frame: %s", err)
+  }
+  if len(payload) > int(MaxFieldSize) {
+    return fmt.Errorf("compressed frame expands to more than %d bytes", MaxFieldSize)
+  }
+
+  // The payload must contain whole frames only
+  inner := NewDecoder(bytes.NewReader(payload))
+  for {
+    f, err := inner.Decode()
+    if err == io.EOF {
+      return nil
+    } else if err != nil {
+      return fmt.Errorf("invalid frame in compressed payload: %s", err)
+    }
+    frame.Frames = append(frame.Frames, f)
+  }
+}
+
+func (d *Decoder) readUint32() (value uint32, err error) {
+  err = binary.Read(d.reader, binary.BigEndian, &value)
+  return
+}
+
+func (d *Decoder) readString() (string, error) {
+  length, err := d.readUint32()
+  if err != nil {
+    return "", err
+  }
+  if length > MaxFieldSize {
+    return "", fmt.Errorf("field of %d bytes is too large", length)
+  }
+
+  buffer := make([]byte, length)
+  if _, err = io.ReadFull(d.reader, buffer); err != nil {
+    return "", err
+  }
+  return string(buffer), nil
+}
+
+// WriteAck acknowledges every data frame up to and including sequence.
+func WriteAck(writer io.Writer, sequence uint32) error {
+  var frame [6]byte
+  frame[0], frame[1] = Version, FrameAck
+  binary.BigEndian.PutUint32(frame[2:], sequence)
+  _, err := writer.Write(frame[:])
+  return err
+}
@@ -0,0 +1,152 @@
+package lumberjack
+
+import (
+  "bytes"
+  "compress/zlib"
+  "encoding/binary"
+  "errors"
+  "io"
+  "net"
+  "testing"
+)
+
+func writeData(output io.Writer, sequence uint32, data map[string]string) {
+  output.Write([]byte("1D"))
+  binary.Write(output, binary.BigEndian, sequence)
+  binary.Write(output, binary.BigEndian, uint32(len(data)))
+  for k, v := range data {
+    binary.Write(output, binary.BigEndian, uint32(len(k)))
+    output.Write([]byte(k))
+    binary.Write(output, binary.BigEndian, uint32(len(v)))
+    output.Write([]byte(v))
+  }
+}
+
+func writeCompressed(output io.Writer, window uint32, first uint32, lines ...string) {
+  var payload bytes.Buffer
+  compressor := zlib.NewWriter(&payload)
+  for i, line := range lines {
+    writeData(compressor, first+uint32(i), map[string]string{"line": line})
+  }
+  compressor.Close()
+
+  output.Write([]byte("1W"))
+  binary.Write(output, binary.BigEndian, window)
+  output.Write([]byte("1C"))
+  binary.Write(output, binary.BigEndian, uint32(payload.Len()))
+  output.Write(payload.Bytes())
+}
+
+func TestDecode(t *testing.T) {
+  var stream bytes.Buffer
+  writeCompressed(&stream, 2, 1, "hello", "world")
+  WriteAck(&stream, 2)
+
+  decoder := NewDecoder(&stream)
+
+  frame, err := decoder.Decode()
+  if err != nil || frame.Type != FrameWindowSize || frame.Window != 2 {
+    t.Fatalf("expected a window frame of 2, got %+v (%v)", frame, err)
+  }
+
+  frame, err = decoder.Decode()
+  if err != nil || frame.Type != FrameCompressed || len(frame.Frames) != 2 {
+    t.Fatalf("expected a compressed frame with 2 frames, got %+v (%v)", frame, err)
+  }
+  data := frame.Frames[1]
+  if data.Type != FrameData || data.Sequence != 2 || data.Data["line"] != "world" {
+    t.Errorf("unexpected data frame: %+v", data)
+  }
+
+  frame, err = decoder.Decode()
+  if err != nil || frame.Type != FrameAck || frame.Sequence != 2 {
+    t.Fatalf("expected an ack for 2, got %+v (%v)", frame, err)
+  }
+
+  if _, err = decoder.Decode(); err != io.EOF {
+    t.Errorf("expected EOF at the end of the stream, got %v", err)
+  }
+}
+
+func TestDecodeTruncated(t *testing.T) {
+  var stream bytes.Buffer
+  writeData(&stream, 1, map[string]string{"line": "hello"})
+
+  decoder := NewDecoder(bytes.NewReader(stream.Bytes()[:stream.Len()-2]))
+  if _, err := decoder.Decode(); err != io.ErrUnexpectedEOF {
+    t.Errorf("expected a truncated frame to fail with ErrUnexpectedEOF, got %v", err)
+  }
+}
+
+func TestDecodeBadVersion(t *testing.T) {
+  decoder := NewDecoder(bytes.NewReader([]byte("2W\x00\x00\x00\x01")))
+  if _, err := decoder.Decode(); err == nil {
+    t.Errorf("expected an unknown version to fail")
+  }
+}
+
+func TestDecodeCompressedTooLarge(t *testing.T) {
+  var payload bytes.Buffer
+  compressor := zlib.NewWriter(&payload)
+  compressor.Write(make([]byte, MaxFieldSize+1))
+  compressor.Close()
+
+  var stream bytes.Buffer
+  stream.Write([]byte("1C"))
+  binary.Write(&stream, binary.BigEndian, uint32(payload.Len()))
+  stream.Write(payload.Bytes())
+
+  decoder := NewDecoder(&stream)
+  if _, err := decoder.Decode(); err == nil {
+    t.Errorf("expected a compressed frame expanding beyond MaxFieldSize to fail")
+  }
+}
+
+func TestServerAcks(t *testing.T) {
+  client, server := net.Pipe()
+
+  received := make(chan []*Event, 2)
+  s := &Server{Handler: func(events []*Event) error {
+    received <- events
+    return nil
+  }}
+  go s.ServeConn(server)
+
+  go func() {
+    writeCompressed(client, 2, 1, "a", "b")
+    writeCompressed(client, 1, 3, "c")
+  }()
+
+  decoder := NewDecoder(client)
+  for _, expected := range []uint32{2, 3} {
+    frame, err := decoder.Decode()
+    if err != nil || frame.Type != FrameAck || frame.Sequence != expected {
+      t.Fatalf("expected an ack for %d, got %+v (%v)", expected, frame, err)
+    }
+  }
+  client.Close()
+
+  if events := <-received; len(events) != 2 || events[1].Fields["line"] != "b" {
+    t.Errorf("unexpected first batch of events")
+  }
+}
+
+func TestServerHandlerError(t *testing.T) {
+  client, server := net.Pipe()
+
+  s := &Server{Handler: func(events []*Event) error {
+    return errors.New("output failed")
+  }}
+  done := make(chan error, 1)
+  go func() { done <- s.ServeConn(server) }()
+
+  go writeCompressed(client, 1, 1, "a")
+
+  // The connection must be closed without an ack
+  if _, err := NewDecoder(client).Decode(); err == nil {
+    t.Errorf("expected no ack when the handler fails")
+  }
+  if err := <-done; err == nil {
+    t.Errorf("expected ServeConn to report the handler error")
+  }
+}
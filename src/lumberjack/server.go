@@ -0,0 +1,132 @@
+package lumberjack
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "log"
+  "net"
+  "time"
+)
+
+// An Event is a data frame received by a Server.
+type Event struct {
+  Sequence uint32
+  Remote   string
+  Fields   map[string]string
+}
+
+// A Handler receives events in the order they were sent. It is called before
+// the events are acknowledged; if it returns an error the connection is
+// closed without acknowledging them, so the writer will send them again.
+type Handler func(events []*Event) error
+
+type Server struct {
+  Handler Handler
+  // Close connections that have been idle for this long. Zero means never.
+  Timeout time.Duration
+}
+
+// Serve accepts connections on the listener, handling each one in its own
+// goroutine, until the listener fails.
+func (s *Server) Serve(listener net.Listener) error {
+  for {
+    conn, err := listener.Accept()
+    if err != nil {
+      return err
+    }
+    go func() {
+      if err := s.ServeConn(conn); err != nil {
+        log.Printf("Connection from %s closed: %s\n", conn.RemoteAddr(), err)
+      }
+    }()
+  }
+}
+
+// ServeConn reads frames from a single connection and acknowledges them. It
+// returns nil when the writer closes the connection.
+func (s *Server) ServeConn(conn net.Conn) error {
+  defer conn.Close()
+
+  c := &connection{
+    server: s,
+    conn:   conn,
+    remote: conn.RemoteAddr().String(),
+    // A safe default until the writer tells us what window size to use
+    window: 1,
+  }
+  decoder := NewDecoder(bufio.NewReader(conn))
+
+  for {
+    if s.Timeout > 0 {
+      conn.SetReadDeadline(time.Now().Add(s.Timeout))
+    }
+    frame, err := decoder.Decode()
+    if err == io.EOF {
+      return nil
+    } else if err != nil {
+      return err
+    }
+
+    if err = c.process(frame); err != nil {
+      return err
+    }
+    if frame.Type == FrameCompressed {
+      // Acknowledge everything in a compressed frame once it is processed
+      if err = c.flush(); err != nil {
+        return err
+      }
+    }
+  }
+}
+
+type connection struct {
+  server   *Server
+  conn     net.Conn
+  remote   string
+  window   uint32
+  last_ack uint32
+  pending  []*Event
+}
+
+func (c *connection) process(frame *Frame) error {
+  switch frame.Type {
+  case FrameWindowSize:
+    c.window = frame.Window
+  case FrameData:
+    c.pending = append(c.pending, &Event{Sequence: frame.Sequence, Remote: c.remote, Fields: frame.Data})
+    if frame.Sequence-c.last_ack >= c.window {
+      return c.flush()
+    }
+  case FrameCompressed:
+    for _, f := range frame.Frames {
+      if err := c.process(f); err != nil {
+        return err
+      }
+    }
+  default:
+    return fmt.Errorf("unexpected frame type %q from writer", frame.Type)
+  }
+  return nil
+}
+
+func (c *connection) flush() error {
+  if len(c.pending) == 0 {
+    return nil
+  }
+
+  if err := c.server.Handler(c.pending); err != nil {
+    return err
+  }
+  sequence := c.pending[len(c.pending)-1].Sequence
+  c.pending = nil
+
+  if c.server.Timeout > 0 {
+    c.conn.SetWriteDeadline(time.Now().Add(c.server.Timeout))
+  }
+  if err := WriteAck(c.conn, sequence); err != nil {
+    return err
+  }
+  c.last_ack = sequence
+  return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+  "bufio"
+  "crypto/tls"
+  "crypto/x509"
+  "encoding/json"
+  "flag"
+  "io/ioutil"
+  "log"
+  "lumberjack"
+  "net"
+  "os"
+  "sync"
+  "time"
+)
+
+var listen = flag.String("listen", ":5043", "The address to listen on")
+var ssl_certificate = flag.String("ssl-certificate", "", "The path to the server ssl certificate. Plain TCP is used if empty")
+var ssl_key = flag.String("ssl-key", "", "The path to the server ssl key")
+var ssl_ca = flag.String("ssl-ca", "", "If set, require client certificates signed by the CAs in this file")
+var output = flag.String("output", "-", "The file to append events to as JSON lines, or - for stdout")
+var timeout = flag.Duration("timeout", 60*time.Second, "Close connections that are idle for this long")
+
+func main() {
+  flag.Parse()
+
+  var file *os.File
+  if *output == "-" {
+    file = os.Stdout
+  } else {
+    var err error
+    file, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+      log.Fatalf("Failed to open output file: %s\n", err)
+    }
+    defer file.Close()
+  }
+
+  // Connections are handled concurrently, so serialize writes to the output
+  var mutex sync.Mutex
+  writer := bufio.NewWriter(file)
+  encoder := json.NewEncoder(writer)
+
+  server := &lumberjack.Server{
+    Timeout: *timeout,
+    Handler: func(events []*lumberjack.Event) error {
+      mutex.Lock()
+      defer mutex.Unlock()
+      for _, event := range events {
+        if err := encoder.Encode(event.Fields); err != nil {
+          return err
+        }
+      }
+      // Only ack events once they have been written out
+      return writer.Flush()
+    },
+  }
+
+  listener, err := net.Listen("tcp", *listen)
+  if err != nil {
+    log.Fatalf("Failed to listen on %s: %s\n", *listen, err)
+  }
+
+  if *ssl_certificate != "" {
+    listener = tls.NewListener(listener, load_tls_config())
+  } else {
+    log.Printf("WARNING: no ssl certificate given, accepting plain TCP connections\n")
+  }
+
+  log.Printf("Listening on %s\n", listener.Addr())
+  log.Fatal(server.Serve(listener))
+}
+
+func load_tls_config() *tls.Config {
+  var config tls.Config
+
+  cert, err := tls.LoadX509KeyPair(*ssl_certificate, *ssl_key)
+  if err != nil {
+    log.Fatalf("Failed loading server ssl certificate: %s\n", err)
+  }
+  config.Certificates = []tls.Certificate{cert}
+
+  if *ssl_ca != "" {
+    pemdata, err := ioutil.ReadFile(*ssl_ca)
+    if err != nil {
+      log.Fatalf("Failure reading CA certificate: %s\n", err)
+    }
+    config.ClientCAs = x509.NewCertPool()
+    if !config.ClientCAs.AppendCertsFromPEM(pemdata) {
+      log.Fatalf("No certificates found in %s\n", *ssl_ca)
+    }
+    config.ClientAuth = tls.RequireAndVerifyClientCert
+  }
+
+  return &config
+}
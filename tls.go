@@ -0,0 +1,385 @@
+package main
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "crypto/tls"
+  "crypto/x509"
+  "encoding/hex"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+)
+
+var tls_versions = map[string]uint16{
+  "1.0": tls.VersionTLS10,
+  "1.1": tls.VersionTLS11,
+  "1.2": tls.VersionTLS12,
+  "1.3": tls.VersionTLS13,
+}
+
+// init_tls checks the ssl settings and parses the versions, cipher suites
+// and pins.
+func (n *NetworkConfig) init_tls() error {
+  var found bool
+  if n.SSLMinVersion != "" {
+    if n.tls_min_version, found = tls_versions[n.SSLMinVersion]; !found {
+      return fmt.Errorf("ssl min version must be 1.0, 1.1, 1.2 or 1.3, not '%s'", n.SSLMinVersion)
+    }
+  }
+  if n.SSLMaxVersion != "" {
+    if n.tls_max_version, found = tls_versions[n.SSLMaxVersion]; !found {
+      return fmt.Errorf("ssl max version must be 1.0, 1.1, 1.2 or 1.3, not '%s'", n.SSLMaxVersion)
+    }
+  }
+  if n.tls_min_version != 0 && n.tls_max_version != 0 && n.tls_min_version > n.tls_max_version {
+    return fmt.Errorf("ssl min version %s is above ssl max version %s", n.SSLMinVersion, n.SSLMaxVersion)
+  }
+
+  n.tls_cipher_suites = nil
+  for _, name := range n.SSLCipherSuites {
+    id, err := cipher_suite(name)
+    if err != nil {
+      return err
+    }
+    n.tls_cipher_suites = append(n.tls_cipher_suites, id)
+  }
+
+  n.tls_pins = nil
+  for _, pin := range n.SSLPins {
+    fingerprint, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+    if err != nil || len(fingerprint) != sha256.Size {
+      return fmt.Errorf("ssl pinned sha256 must be a hex SHA-256 fingerprint, not '%s'", pin)
+    }
+    n.tls_pins = append(n.tls_pins, fingerprint)
+  }
+  return nil
+}
+
+// cipher_suite looks up a cipher suite by its name in the crypto/tls
+// package, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+func cipher_suite(name string) (uint16, error) {
+  for _, suite := range tls.CipherSuites() {
+    if suite.Name == name {
+      return suite.ID, nil
+    }
+  }
+  for _, suite := range tls.InsecureCipherSuites() {
+    if suite.Name == name {
+      log.Printf("WARNING: TLS: cipher suite %s is insecure\n", name)
+      return suite.ID, nil
+    }
+  }
+  return 0, fmt.Errorf("unknown ssl cipher suite '%s'", name)
+}
+
+// TLSMaterial holds the client certificate and trusted CAs of a network
+// config. They are loaded again when their files change, so certificates
+// rotated on disk are used from the next connection on. If loading fails,
+// say because a file is halfway through being replaced, the last good ones
+// are kept.
+type TLSMaterial struct {
+  config *NetworkConfig
+  mutex sync.Mutex
+  loaded bool
+  certificates []tls.Certificate
+  roots *x509.CertPool
+  files map[string]os.FileInfo /* as they were when last loaded */
+  notify chan struct{}
+  done chan bool
+}
+
+// NewTLSMaterial loads the certificates of a network config and starts
+// watching their files, or returns nil if the config's transport doesn't
+// use TLS.
+func NewTLSMaterial(config *NetworkConfig) *TLSMaterial {
+  if config.Transport == transport_tcp {
+    return nil
+  }
+  m := &TLSMaterial{
+    config: config,
+    notify: make(chan struct{}, 1),
+    done: make(chan bool),
+  }
+  if _, err := m.reload(); err != nil {
+    m.failed(err)
+  }
+
+  // Watch the files and the directories they're in, as certificates are
+  // often replaced by renaming new files or symlinks over them
+  watched := make(map[string]bool)
+  for _, path := range m.paths() {
+    for _, watch := range []string{path, filepath.Dir(path)} {
+      if _, err := os.Stat(watch); err != nil || watched[watch] {
+        continue
+      }
+      watched[watch] = true
+      if err := watcher.Watch(watch, m.notify); err != nil {
+        log.Printf("Failed to watch %s for new ssl certificates, will check it when reconnecting: %s\n", watch, err)
+      }
+    }
+  }
+  go m.watch()
+  return m
+}
+
+func (m *TLSMaterial) watch() {
+  for {
+    select {
+    case <-m.notify:
+      if reloaded, err := m.reload(); err != nil {
+        m.failed(err)
+      } else if reloaded {
+        log.Printf("Reloaded ssl certificates, they will be used from the next connection\n")
+      }
+    case <-m.done:
+      return
+    }
+  }
+}
+
+// Close stops watching the files.
+func (m *TLSMaterial) Close() {
+  if m == nil {
+    return
+  }
+  watcher.Unwatch(m.notify)
+  close(m.done)
+}
+
+// get returns the certificates to use for a new connection, reloading them
+// first if their files changed. It only fails if they have never loaded.
+func (m *TLSMaterial) get() ([]tls.Certificate, *x509.CertPool, error) {
+  if _, err := m.reload(); err != nil && !m.failed(err) {
+    return nil, nil, err
+  }
+
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+  return m.certificates, m.roots, nil
+}
+
+// failed logs a failure to load the certificates, and reports whether there
+// are good ones from before to keep using.
+func (m *TLSMaterial) failed(err error) bool {
+  m.mutex.Lock()
+  loaded := m.loaded
+  m.mutex.Unlock()
+  if loaded {
+    log.Printf("Failed reloading ssl certificates, keeping the last good ones: %s\n", err)
+  } else {
+    log.Printf("Failed loading ssl certificates, will try again when they change: %s\n", err)
+  }
+  return loaded
+}
+
+// reload loads the certificates again if their files changed since they
+// were last loaded, and reports whether it did.
+func (m *TLSMaterial) reload() (bool, error) {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  files := m.stat()
+  if m.loaded && same_files(files, m.files) {
+    return false, nil
+  }
+
+  var certificates []tls.Certificate
+  if len(m.config.SSLCertificate) > 0 && len(m.config.SSLKey) > 0 {
+    log.Printf("Loading client ssl certificate: %s and %s\n",
+      m.config.SSLCertificate, m.config.SSLKey)
+    cert, err := tls.LoadX509KeyPair(m.config.SSLCertificate, m.config.SSLKey)
+    if err != nil {
+      return false, fmt.Errorf("client ssl certificate: %s", err)
+    }
+    certificates = []tls.Certificate{cert}
+  }
+
+  var roots *x509.CertPool
+  if len(m.config.SSLCA) > 0 || len(m.config.SSLCADirectory) > 0 {
+    var err error
+    if roots, err = load_ca(m.config.SSLCA, m.config.SSLCADirectory); err != nil {
+      return false, fmt.Errorf("trusted CAs: %s", err)
+    }
+  }
+
+  m.certificates, m.roots, m.files = certificates, roots, files
+  m.loaded = true
+  return true, nil
+}
+
+// stat returns the files the certificates are loaded from as they are now,
+// by path. Files that can't be read are left out, so they are seen as
+// changed once they can.
+func (m *TLSMaterial) stat() map[string]os.FileInfo {
+  paths := m.paths()
+  if m.config.SSLCADirectory != "" {
+    if files, err := ioutil.ReadDir(m.config.SSLCADirectory); err == nil {
+      for _, file := range files {
+        paths = append(paths, filepath.Join(m.config.SSLCADirectory, file.Name()))
+      }
+    }
+  }
+
+  files := make(map[string]os.FileInfo)
+  for _, path := range paths {
+    if info, err := os.Stat(path); err == nil {
+      files[path] = info
+    }
+  }
+  return files
+}
+
+// paths returns the configured certificate, key and CA paths.
+func (m *TLSMaterial) paths() []string {
+  var paths []string
+  for _, path := range []string{m.config.SSLCertificate, m.config.SSLKey, m.config.SSLCA, m.config.SSLCADirectory} {
+    if path != "" {
+      paths = append(paths, path)
+    }
+  }
+  return paths
+}
+
+func same_files(a map[string]os.FileInfo, b map[string]os.FileInfo) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for path, info := range a {
+    other, found := b[path]
+    if !found || !os.SameFile(info, other) || !info.ModTime().Equal(other.ModTime()) || info.Size() != other.Size() {
+      return false
+    }
+  }
+  return true
+}
+
+// load_tls_config makes the TLS configuration for connecting to host, with
+// the current client certificate and trusted CAs.
+func load_tls_config(config *NetworkConfig, material *TLSMaterial, host string) (*tls.Config, error) {
+  certificates, roots, err := material.get()
+  if err != nil {
+    return nil, fmt.Errorf("no usable ssl certificates: %s", err)
+  }
+  tlsconfig := &tls.Config{
+    Certificates: certificates,
+    RootCAs:      roots,
+    MinVersion:   config.tls_min_version,
+    MaxVersion:   config.tls_max_version,
+    CipherSuites: config.tls_cipher_suites,
+  }
+
+  // Send the name for SNI, and verify the certificate against it
+  tlsconfig.ServerName = host
+  if config.SSLServerName != "" {
+    tlsconfig.ServerName = config.SSLServerName
+  }
+
+  if !config.SSLStrict {
+    if len(config.tls_pins) == 0 {
+      log.Println("WARNING: TLS: InsecureSkipVerify: you are susceptible to MITM attacks. ")
+    }
+    tlsconfig.InsecureSkipVerify = true
+  }
+  if len(config.tls_pins) > 0 {
+    pins := config.tls_pins
+    tlsconfig.VerifyConnection = func(state tls.ConnectionState) error {
+      return verify_pins(state.PeerCertificates, pins)
+    }
+  }
+  return tlsconfig, nil
+}
+
+// load_ca reads every certificate in a PEM bundle, and in every file in a
+// directory, into a pool. Files in the directory without certificates, such
+// as READMEs or keys, are skipped.
+func load_ca(bundle string, directory string) (*x509.CertPool, error) {
+  pool := x509.NewCertPool()
+  count := 0
+
+  if bundle != "" {
+    log.Printf("Setting trusted CA from file: %s\n", bundle)
+    pemdata, err := ioutil.ReadFile(bundle)
+    if err != nil {
+      return nil, err
+    }
+    added, err := add_certificates(pool, pemdata)
+    if err != nil {
+      return nil, fmt.Errorf("%s: %s", bundle, err)
+    }
+    if added == 0 {
+      return nil, fmt.Errorf("no certificates found in %s", bundle)
+    }
+    count += added
+  }
+
+  if directory != "" {
+    log.Printf("Setting trusted CAs from directory: %s\n", directory)
+    files, err := ioutil.ReadDir(directory)
+    if err != nil {
+      return nil, err
+    }
+    for _, file := range files {
+      if file.IsDir() {
+        continue
+      }
+      path := filepath.Join(directory, file.Name())
+      pemdata, err := ioutil.ReadFile(path)
+      if err != nil {
+        return nil, err
+      }
+      added, err := add_certificates(pool, pemdata)
+      if err != nil {
+        return nil, fmt.Errorf("%s: %s", path, err)
+      }
+      count += added
+    }
+    if count == 0 {
+      return nil, fmt.Errorf("no certificates found in %s", directory)
+    }
+  }
+  return pool, nil
+}
+
+// add_certificates adds each certificate in PEM data to a pool, and returns
+// how many there were.
+func add_certificates(pool *x509.CertPool, pemdata []byte) (int, error) {
+  count := 0
+  for {
+    var block *pem.Block
+    block, pemdata = pem.Decode(pemdata)
+    if block == nil {
+      return count, nil
+    }
+    if block.Type != "CERTIFICATE" {
+      continue
+    }
+    cert, err := x509.ParseCertificate(block.Bytes)
+    if err != nil {
+      return count, fmt.Errorf("failed to parse a certificate: %s", err)
+    }
+    pool.AddCert(cert)
+    count++
+  }
+}
+
+// verify_pins checks that the server's certificate has one of the pinned
+// SHA-256 fingerprints.
+func verify_pins(certificates []*x509.Certificate, pins [][]byte) error {
+  if len(certificates) == 0 {
+    return errors.New("no server certificate to check the pins of")
+  }
+  fingerprint := sha256.Sum256(certificates[0].Raw)
+  for _, pin := range pins {
+    if bytes.Equal(pin, fingerprint[:]) {
+      return nil
+    }
+  }
+  return fmt.Errorf("server certificate sha256 %s is not pinned", hex.EncodeToString(fingerprint[:]))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func certificatePEM(cert tls.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+}
+
+func TestLoadCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-ca")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A bundle of several certificates, with a key mixed in
+	bundle := append(certificatePEM(makeCert("one")), caKey+"\n"...)
+	bundle = append(bundle, certificatePEM(makeCert("two"))...)
+	ioutil.WriteFile(filepath.Join(dir, "bundle.pem"), bundle, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "three.crt"), certificatePEM(makeCert("three")), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a certificate\n"), 0644)
+
+	count := func(bundle string, directory string) int {
+		pool, err := load_ca(bundle, directory)
+		if err != nil {
+			t.Fatalf("Unexpected error loading %s and %s: %s", bundle, directory, err)
+		}
+		return len(pool.Subjects())
+	}
+	if n := count(filepath.Join(dir, "bundle.pem"), ""); n != 2 {
+		t.Errorf("Expected 2 certificates from the bundle, got %d", n)
+	}
+	if n := count("", dir); n != 3 {
+		t.Errorf("Expected 3 certificates from the directory, got %d", n)
+	}
+
+	if _, err := load_ca(filepath.Join(dir, "README"), ""); err == nil {
+		t.Errorf("Expected an error loading a bundle without certificates")
+	}
+}
+
+func TestInitTLS(t *testing.T) {
+	config := &NetworkConfig{
+		SSLMinVersion:   "1.2",
+		SSLCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		SSLPins:         []string{"AB:" + hex.EncodeToString(make([]byte, 31))},
+	}
+	if err := config.init_tls(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if config.tls_min_version != tls.VersionTLS12 || len(config.tls_cipher_suites) != 1 || len(config.tls_pins) != 1 || config.tls_pins[0][0] != 0xab {
+		t.Errorf("Unexpected settings: %+v", config)
+	}
+
+	for _, invalid := range []*NetworkConfig{
+		{SSLMinVersion: "3.0"},
+		{SSLMinVersion: "1.3", SSLMaxVersion: "1.2"},
+		{SSLCipherSuites: []string{"TLS_NOPE"}},
+		{SSLPins: []string{"abcd"}},
+	} {
+		if err := invalid.init_tls(); err == nil {
+			t.Errorf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestConnectTLSSettings(t *testing.T) {
+	cert := makeCert("localhost")
+	server_names := make(chan string, 10)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			server_names <- hello.ServerName
+			return nil, nil
+		},
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		testBug(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	config := &NetworkConfig{
+		SSLServerName: "logs.example.com",
+		SSLMaxVersion: "1.2",
+		SSLPins:       []string{hex.EncodeToString(fingerprint[:])},
+		timeout:       5 * time.Second,
+	}
+	if err := config.init_tls(); err != nil {
+		testBug(err)
+	}
+	material := NewTLSMaterial(config)
+	defer material.Close()
+	socket, err := connect_server(config, material, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected to connect to the pinned server, got %s", err)
+	}
+	if version := socket.(*tls.Conn).ConnectionState().Version; version != tls.VersionTLS12 {
+		t.Errorf("Expected TLS 1.2, got %x", version)
+	}
+	socket.Close()
+	if name := <-server_names; name != "logs.example.com" {
+		t.Errorf("Expected the server name to be sent for SNI, got '%s'", name)
+	}
+
+	// A certificate that isn't pinned is rejected
+	config.SSLPins = []string{hex.EncodeToString(make([]byte, sha256.Size))}
+	config.init_tls()
+	if socket, err := connect_server(config, material, listener.Addr().String()); err == nil {
+		socket.Close()
+		t.Fatalf("Expected a server certificate that isn't pinned to be rejected")
+	}
+}
+
+// replaceFile writes a file and renames it into place, as certificate
+// managers do.
+func replaceFile(path string, data []byte) {
+	if err := ioutil.WriteFile(path+".new", data, 0600); err != nil {
+		testBug(err)
+	}
+	if err := os.Rename(path+".new", path); err != nil {
+		testBug(err)
+	}
+}
+
+func writeKeyPair(dir string, cert tls.Certificate) {
+	key := x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey))
+	replaceFile(filepath.Join(dir, "client.key"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: key}))
+	replaceFile(filepath.Join(dir, "client.crt"), certificatePEM(cert))
+}
+
+func TestTLSMaterialReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-tls")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &NetworkConfig{
+		SSLCertificate: filepath.Join(dir, "client.crt"),
+		SSLKey:         filepath.Join(dir, "client.key"),
+	}
+
+	// Nothing to fall back on before the files exist
+	material := NewTLSMaterial(config)
+	defer material.Close()
+	if _, _, err := material.get(); err == nil {
+		t.Fatalf("Expected an error without a certificate")
+	}
+
+	current := func() []byte {
+		certificates, _, err := material.get()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return certificates[0].Certificate[0]
+	}
+	one, two := makeCert("one"), makeCert("two")
+	writeKeyPair(dir, one)
+	if !bytes.Equal(current(), one.Certificate[0]) {
+		t.Fatalf("Expected the first certificate once it was written")
+	}
+
+	// Halfway through being replaced, the last good certificate is kept
+	replaceFile(config.SSLCertificate, certificatePEM(two)[:100])
+	if !bytes.Equal(current(), one.Certificate[0]) {
+		t.Fatalf("Expected to keep the first certificate while the new one is incomplete")
+	}
+
+	writeKeyPair(dir, two)
+	if !bytes.Equal(current(), two.Certificate[0]) {
+		t.Fatalf("Expected the second certificate once it was replaced")
+	}
+
+	if NewTLSMaterial(&NetworkConfig{Transport: transport_tcp}) != nil {
+		t.Errorf("Expected no certificates for the tcp transport")
+	}
+}
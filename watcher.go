@@ -0,0 +1,33 @@
+package main
+
+// The watcher the prospectors and harvesters use to hear about changes to
+// files, or nil if they only poll.
+var watcher *Watcher
+
+// Watch asks for a notification on notify when the file at path is written
+// to, or, for a directory, when a file is created in or moved into it. One
+// notification may stand for several changes, and some may be spurious, so
+// whoever is notified should look at the file again rather than trust it.
+func (w *Watcher) Watch(path string, notify chan struct{}) error {
+  if w == nil {
+    return nil
+  }
+  return w.add(path, notify)
+}
+
+// Unwatch stops all notifications on notify.
+func (w *Watcher) Unwatch(notify chan struct{}) {
+  if w == nil {
+    return
+  }
+  w.remove(notify)
+}
+
+// send_notification notifies without blocking. Notifications are buffered
+// one deep, so a notification that is already pending covers this one too.
+func send_notification(notify chan struct{}) {
+  select {
+  case notify <- struct{}{}:
+  default:
+  }
+}
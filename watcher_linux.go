@@ -0,0 +1,122 @@
+package main
+
+import (
+  "log"
+  "os"
+  "sync"
+  "syscall"
+  "unsafe"
+)
+
+// A Watcher watches files and directories with inotify.
+type Watcher struct {
+  fd int
+  mutex sync.Mutex
+  watches map[int32][]chan struct{} /* who to notify for each watch descriptor */
+}
+
+func NewWatcher() (*Watcher, error) {
+  fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+  if err != nil {
+    return nil, err
+  }
+
+  w := &Watcher{fd: fd, watches: make(map[int32][]chan struct{})}
+  go w.run()
+  return w, nil
+}
+
+func (w *Watcher) add(path string, notify chan struct{}) error {
+  info, err := os.Stat(path)
+  if err != nil {
+    return err
+  }
+  var mask uint32 = syscall.IN_MODIFY
+  if info.IsDir() {
+    mask = syscall.IN_CREATE | syscall.IN_MOVED_TO
+  }
+
+  w.mutex.Lock()
+  defer w.mutex.Unlock()
+
+  // A file has one watch however many times it is watched, so add to its
+  // mask rather than replace it
+  wd, err := syscall.InotifyAddWatch(w.fd, path, mask|syscall.IN_MASK_ADD)
+  if err != nil {
+    return err
+  }
+  for _, existing := range w.watches[int32(wd)] {
+    if existing == notify {
+      return nil
+    }
+  }
+  w.watches[int32(wd)] = append(w.watches[int32(wd)], notify)
+  return nil
+}
+
+func (w *Watcher) remove(notify chan struct{}) {
+  w.mutex.Lock()
+  defer w.mutex.Unlock()
+
+  for wd, channels := range w.watches {
+    kept := make([]chan struct{}, 0, len(channels))
+    for _, channel := range channels {
+      if channel != notify {
+        kept = append(kept, channel)
+      }
+    }
+    if len(kept) == len(channels) {
+      continue
+    }
+
+    if len(kept) == 0 {
+      syscall.InotifyRmWatch(w.fd, uint32(wd))
+      delete(w.watches, wd)
+    } else {
+      w.watches[wd] = kept
+    }
+  }
+}
+
+func (w *Watcher) run() {
+  buffer := make([]byte, 256*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+  for {
+    n, err := syscall.Read(w.fd, buffer)
+    if err == syscall.EINTR {
+      continue
+    }
+    if err != nil {
+      log.Printf("Failed to read file changes, polling for them instead: %s\n", err)
+      return
+    }
+
+    for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+      event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+      w.notify(event.Wd, event.Mask)
+      offset += syscall.SizeofInotifyEvent + int(event.Len)
+    }
+  }
+}
+
+func (w *Watcher) notify(wd int32, mask uint32) {
+  w.mutex.Lock()
+  defer w.mutex.Unlock()
+
+  if mask&syscall.IN_Q_OVERFLOW != 0 {
+    // Changes were lost, so everyone has to look again
+    for _, channels := range w.watches {
+      for _, notify := range channels {
+        send_notification(notify)
+      }
+    }
+    return
+  }
+
+  for _, notify := range w.watches[wd] {
+    send_notification(notify)
+  }
+  if mask&syscall.IN_IGNORED != 0 {
+    // The file is gone, or its watch was removed
+    delete(w.watches, wd)
+  }
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to start watcher: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "logstash-forwarder-watch")
+	if err != nil {
+		testBug(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notified := func(notify chan struct{}) bool {
+		select {
+		case <-notify:
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	directory := make(chan struct{}, 1)
+	if err = w.Watch(dir, directory); err != nil {
+		t.Fatalf("Failed to watch %s: %s", dir, err)
+	}
+	path := filepath.Join(dir, "new.log")
+	file, err := os.Create(path)
+	if err != nil {
+		testBug(err)
+	}
+	defer file.Close()
+	if !notified(directory) {
+		t.Fatalf("Expected a notification when a file was created")
+	}
+
+	// Two watchers of the same file are both notified
+	first, second := make(chan struct{}, 1), make(chan struct{}, 1)
+	w.Watch(path, first)
+	w.Watch(path, second)
+	file.WriteString("line\n")
+	if !notified(first) || !notified(second) {
+		t.Fatalf("Expected both watchers to be notified of a write")
+	}
+
+	w.Unwatch(first)
+	file.WriteString("line\n")
+	if !notified(second) {
+		t.Fatalf("Expected the remaining watcher to be notified of a write")
+	}
+	select {
+	case <-first:
+		t.Fatalf("Expected no notification after unwatching")
+	default:
+	}
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+// Only Linux can watch files for changes, everywhere else polls.
+type Watcher struct{}
+
+func NewWatcher() (*Watcher, error) {
+  return nil, errors.New("watching files for changes is only supported on Linux")
+}
+
+func (w *Watcher) add(path string, notify chan struct{}) error {
+  return nil
+}
+
+func (w *Watcher) remove(notify chan struct{}) {
+}